@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Aggregate selects how the magnitudes stored in history are combined
+// into a single value per bin.
+type Aggregate int
+
+const (
+	aggregateMin Aggregate = iota
+	aggregateMax
+	aggregateMean
+	aggregateMedian
+	aggregateEMA
+)
+
+var aggregateNames = []string{"min", "max", "mean", "median", "ema"}
+
+func (aggregate Aggregate) String() string {
+	return aggregateNames[aggregate]
+}
+
+func (aggregate *Aggregate) Set(value string) error {
+	for i, name := range aggregateNames {
+		if name == value {
+			*aggregate = (Aggregate)(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown aggregate %q, expected one of: %s", value, strings.Join(aggregateNames, ", "))
+}
+
+func (aggregate Aggregate) next() Aggregate {
+	return (aggregate + 1) % (Aggregate)(len(aggregateNames))
+}
+
+func (data *AudioData) magnitudeAt(index int, aggregate Aggregate, emaDecay float64) float64 {
+	switch aggregate {
+	case aggregateMax:
+		return data.maxMagnitudeAt(index)
+	case aggregateMean:
+		return data.avgMagnitudeAt(index)
+	case aggregateMedian:
+		return data.medianMagnitudeAt(index)
+	case aggregateEMA:
+		return data.emaMagnitudeAt(index, emaDecay)
+	}
+	return data.minMagnitudeAt(index)
+}
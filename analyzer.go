@@ -9,6 +9,7 @@ import "C"
 import (
 	"os"
 	"io"
+	"bufio"
 	"errors"
 	"flag"
 	"fmt"
@@ -16,9 +17,9 @@ import (
 	"sync"
 	"sort"
 	"math"
+	"strings"
 	"github.com/veandco/go-sdl2/sdl"
 	"github.com/veandco/go-sdl2/ttf"
-	"github.com/jvlmdr/go-fftw/fftw"
 )
 
 type Options struct {
@@ -28,58 +29,202 @@ type Options struct {
 	samples int
 	historySize int
 	interval int
-	minPeakValue float64
+	threshold ThresholdSettings
 	topPeaks int
 	toneFile string
 	tones Tones
+	// error of loading the tone file
+	toneError error
+	aggregate Aggregate
+	emaDecay float64
+	interpolation Interpolation
+	toneTolerance float64
+	detector Detector
+	reference float64
+	pitchThreshold float64
+	minPitch float64
+	maxPitch float64
+	minClarity float64
+	polyMinEnergy float64
+	trackTolerance float64
+	trackGap int
+	minSustain int
+	calibrateNoise float64
+	noiseFile string
+	noiseFactor float64
+	decibels bool
+	dbFloor float64
+	logFrequency bool
+	noteLabels bool
+	view View
+	waterfallSeconds float64
+	width int
+	height int
+	input string
+	record string
+	recordBuffer float64
+	dump string
+	replay string
+	render string
+	renderAt float64
+}
+
+func (options *Options) binFrequency() float64 {
+	return (float64)(options.frequency) / (float64)(options.samples)
+}
+
+const defaultNoiseCalibration = 3
+
+func (options *Options) noiseCalibrationTime() float64 {
+	if options.calibrateNoise > 0 {
+		return options.calibrateNoise
+	}
+	return defaultNoiseCalibration
 }
 
 type DisplaySettings struct {
 	maxValue float64
-	from int
-	minFrom int
-	to int
-	maxTo int
+	// visible range of bins, every bin is centered at its index
+	low float64
+	high float64
+	minLow float64
+	maxHigh float64
+	// logarithmic axes
+	decibels bool
+	dbFloor float64
+	logFrequency bool
+	// label the grid by note names instead of Hz
+	noteLabels bool
+	binFrequency float64
+	reference float64
 }
 
-func (settings *DisplaySettings) init(to int) {
+// minimal number of bins in the view
+const minViewBins = 3
+
+func (settings *DisplaySettings) init(options Options) {
 	settings.maxValue = 100
-	settings.minFrom = 1 // skip DC part
-	settings.from = settings.minFrom
-	settings.maxTo = to
-	settings.to = settings.maxTo
+	settings.minLow = 0.5 // skip DC part
+	settings.low = settings.minLow
+	settings.maxHigh = (float64)(options.samples/2) - 0.5
+	settings.high = settings.maxHigh
+	settings.decibels = options.decibels
+	settings.dbFloor = -math.Abs(options.dbFloor)
+	settings.logFrequency = options.logFrequency
+	settings.noteLabels = options.noteLabels
+	settings.binFrequency = options.binFrequency()
+	settings.reference = options.reference
+}
+
+// viewRange returns bins at the left and the right edge of the view.
+func (settings *DisplaySettings) viewRange() (float64, float64) {
+	return settings.low, settings.high
+}
+
+// visibleBins returns range of bins at least partially visible.
+func (settings *DisplaySettings) visibleBins() (int, int) {
+	from := (int)(math.Floor(settings.low + 0.5))
+	to := (int)(math.Ceil(settings.high + 0.5))
+	return from, (int)(math.Min((float64)(to), settings.maxHigh+0.5))
+}
+
+// axis converts bin to coordinate in which the axis is linear.
+func (settings *DisplaySettings) axis(bin float64) float64 {
+	if settings.logFrequency {
+		return math.Log(bin)
+	}
+	return bin
+}
+
+func (settings *DisplaySettings) fromAxis(coordinate float64) float64 {
+	if settings.logFrequency {
+		return math.Exp(coordinate)
+	}
+	return coordinate
+}
+
+// position returns relative horizontal position of bin in the view.
+func (settings *DisplaySettings) position(bin float64) float64 {
+	if settings.logFrequency {
+		bin = math.Max(bin, settings.low/2)
+	}
+	low, high := settings.axis(settings.low), settings.axis(settings.high)
+	return (settings.axis(bin) - low) / (high - low)
+}
+
+// binAt is inverse to position.
+func (settings *DisplaySettings) binAt(position float64) float64 {
+	low, high := settings.axis(settings.low), settings.axis(settings.high)
+	return settings.fromAxis(low + position*(high-low))
+}
+
+// level returns relative height of value in the view.
+func (settings *DisplaySettings) level(value float64) float64 {
+	if settings.decibels {
+		if value <= 0 {
+			return 0
+		}
+		return math.Max(0, 1-decibels(value, settings.maxValue)/settings.dbFloor)
+	}
+	return value / settings.maxValue
+}
+
+func decibels(value float64, reference float64) float64 {
+	return 20 * math.Log10(value/reference)
 }
 
 func (settings *DisplaySettings) bars() int {
-	return settings.to - settings.from
+	return (int)(math.Ceil(settings.high - settings.low))
 }
 
 func (settings *DisplaySettings) zoomY(scale float64) {
 	settings.maxValue *= scale
 }
 
+// setRange shows bins between low and high keeping the view within the
+// spectrum and at least minViewBins wide.
+func (settings *DisplaySettings) setRange(low float64, high float64) {
+	if low > high {
+		low, high = high, low
+	}
+	if high-low < minViewBins {
+		center := (low + high) / 2
+		low, high = center-minViewBins/2.0, center+minViewBins/2.0
+	}
+	if high-low >= settings.maxHigh-settings.minLow {
+		low, high = settings.minLow, settings.maxHigh
+	} else if low < settings.minLow {
+		low, high = settings.minLow, settings.minLow+(high-low)
+	} else if high > settings.maxHigh {
+		low, high = settings.maxHigh-(high-low), settings.maxHigh
+	}
+	settings.low, settings.high = low, high
+}
+
+// zoomAround scales the view keeping bin at position in place.
+func (settings *DisplaySettings) zoomAround(position float64, scale float64) {
+	center := settings.axis(settings.binAt(position))
+	low := center - (center-settings.axis(settings.low))/scale
+	high := center + (settings.axis(settings.high)-center)/scale
+	settings.setRange(settings.fromAxis(low), settings.fromAxis(high))
+}
+
 func (settings *DisplaySettings) zoomX(scale float64) {
-	// FIXME: crashing when shifted
-	bars := settings.bars()
-	bars = (int)((float64)(bars) / scale)
-	// bars must be bigger then 3 and smaller then max diff
-	bars = (int)(math.Max((float64)(bars), 3))
-	bars = (int)(math.Min((float64)(bars), (float64)(settings.maxTo - settings.minFrom)))
-	// apply the scale
-	settings.to = settings.from + bars
+	settings.zoomAround(0.5, scale)
+}
+
+// pan moves the view by part of its width.
+func (settings *DisplaySettings) pan(part float64) {
+	low, high := settings.axis(settings.low), settings.axis(settings.high)
+	shift := part * (high - low)
+	minLow, maxHigh := settings.axis(settings.minLow), settings.axis(settings.maxHigh)
+	shift = math.Max(shift, minLow-low)
+	shift = math.Min(shift, maxHigh-high)
+	settings.low, settings.high = settings.fromAxis(low+shift), settings.fromAxis(high+shift)
 }
 
 func (settings *DisplaySettings) shiftX(relativeStep float64) {
-	bars := settings.bars()
-	if relativeStep > 0 {
-		settings.to += (int)((float64)(bars)/relativeStep)
-		settings.to = (int)(math.Min((float64)(settings.to), (float64)(settings.maxTo)))
-		settings.from = settings.to - bars
-	} else {
-		settings.from += (int)((float64)(bars)/relativeStep)
-		settings.from = (int)(math.Max((float64)(settings.from), (float64)(settings.minFrom)))
-		settings.to = settings.from + bars
-	}
+	settings.pan(1 / relativeStep)
 }
 
 type Gui struct {
@@ -89,10 +234,50 @@ type Gui struct {
 	surface *sdl.Surface
 	settings DisplaySettings
 	font *ttf.Font
+	view View
+	// spectrum panel
+	area sdl.Rect
+	waterfallArea sdl.Rect
+	waterfall Waterfall
+	mouse MouseState
+	// overlay of configured tones
+	showTemplates bool
+	hiddenTones map[string]bool
+	legend []legendEntry
+	editor ToneEditor
 }
 
-func (gui *Gui) barWidth() int32 {
-	return gui.width / (int32)(gui.settings.bars())
+func (gui *Gui) layout() {
+	gui.area = sdl.Rect{0, 0, gui.width, gui.height}
+	gui.waterfallArea = sdl.Rect{0, 0, gui.width, 0}
+	switch gui.view {
+	case viewBoth:
+		gui.waterfallArea.H = gui.height / 2
+		gui.area.Y = gui.waterfallArea.H
+		gui.area.H = gui.height - gui.waterfallArea.H
+	case viewWaterfall:
+		gui.waterfallArea.H = gui.height
+		gui.area.Y = gui.height
+		gui.area.H = 0
+	}
+}
+
+func (gui *Gui) resize(width int32, height int32) {
+	var error error
+	gui.width = width
+	gui.height = height
+	// the old surface is invalidated by the resize
+	gui.surface, error = gui.window.GetSurface()
+	print_error(error)
+	gui.layout()
+}
+
+func (gui *Gui) xOf(bin float64) int32 {
+	return gui.area.X + (int32)(math.Round(gui.settings.position(bin) * (float64)(gui.area.W)))
+}
+
+func (gui *Gui) yOf(value float64) int32 {
+	return gui.area.Y + gui.area.H - (int32)(gui.settings.level(value) * (float64)(gui.area.H))
 }
 
 func (gui *Gui) clear() {
@@ -105,29 +290,52 @@ func (gui *Gui) clear() {
 
 func (gui *Gui) barRect(index int, value float64) sdl.Rect {
 	var rect sdl.Rect
-	barWidth := gui.barWidth()
-	barHeight := (int32)((value / gui.settings.maxValue) * (float64)(gui.height))
-	rect.X = (int32)(index-gui.settings.from) * barWidth
-	rect.Y = gui.height - barHeight
-	rect.W = barWidth
-	rect.H = (int32)(barHeight)
+	rect.X = gui.xOf((float64)(index) - 0.5)
+	rect.Y = gui.yOf(value)
+	rect.W = (int32)(math.Max(1, (float64)(gui.xOf((float64)(index) + 0.5) - rect.X)))
+	rect.H = gui.area.Y + gui.area.H - rect.Y
 	return rect
 }
 
 const peakHeight = 3
-func (gui *Gui) drawPeak(peak Peak) {
-	peakRect := gui.barRect(peak.index, peak.value)
+func (gui *Gui) drawPeak(peak Peak, sustained bool) {
+	var peakRect sdl.Rect
 	peakColor := sdl.Color{255, 0, 255, 0}.Uint32()
-	peakRect.Y -= peakHeight
-	peakRect.X -= gui.barWidth()
-	peakRect.W = gui.barWidth()*3
+	if !sustained {
+		peakColor = sdl.Color{255, 128, 128, 128}.Uint32()
+	}
+	peakRect.X = gui.xOf(peak.bin - 1.5)
+	peakRect.Y = gui.yOf(peak.value) - peakHeight
+	peakRect.W = (int32)(math.Max(3, (float64)(gui.xOf(peak.bin + 1.5) - peakRect.X)))
 	peakRect.H = peakHeight
 	gui.surface.FillRect(&peakRect, peakColor)
 }
 
 func (gui *Gui) drawPeaks(data *AggregatedData) {
 	for _, peak := range data.peaks {
-		gui.drawPeak(peak)
+		gui.drawPeak(peak, data.sustained(peak))
+	}
+}
+
+func (gui *Gui) drawThreshold(data *AggregatedData) {
+	thresholdColor := sdl.Color{255, 0, 255, 255}.Uint32()
+	if gui.settings.bars() > (int)(gui.area.W) {
+		for x := (int32)(0); x < gui.area.W; x++ {
+			from, to := gui.columnBins(x, gui.area.W, len(data.threshold))
+			value := 0.0
+			for i := from; i < to; i++ {
+				value = math.Max(value, data.threshold[i])
+			}
+			lineRect := sdl.Rect{gui.area.X + x, gui.yOf(value), 1, 1}
+			gui.surface.FillRect(&lineRect, thresholdColor)
+		}
+		return
+	}
+	from, to := gui.settings.visibleBins()
+	for i := from; i < to; i++ {
+		lineRect := gui.barRect(i, data.threshold[i])
+		lineRect.H = 1
+		gui.surface.FillRect(&lineRect, thresholdColor)
 	}
 }
 
@@ -138,30 +346,40 @@ func (gui *Gui) drawBar(index int, value float64) {
 }
 
 func (gui *Gui) drawBars(data *AggregatedData) {
-	for i := gui.settings.from; i < gui.settings.to; i++ {
+	if gui.settings.bars() > (int)(gui.area.W) {
+		gui.drawColumns(data.values)
+		return
+	}
+	from, to := gui.settings.visibleBins()
+	for i := from; i < to; i++ {
 		gui.drawBar(i, data.values[i])
 	}
 }
 
-func (gui *Gui) drawScales() {
-	var scales = []int32{100, 10, 5, 2}
-	bars := gui.settings.bars()
-	var scale int32
-	var scaleRect sdl.Rect
-	scaleColor := sdl.Color{255, 0, 0, 255}.Uint32()
-	for _, potentialScale := range scales {
-		scale = potentialScale
-		if (int32)(bars) / potentialScale > 3 {
-			break
+// drawColumns draws one column per pixel showing maximum of its bins, used
+// when there are more bins than pixels.
+func (gui *Gui) drawColumns(values []float64) {
+	barColor := sdl.Color{255, 255, 0, 0}.Uint32()
+	for x := (int32)(0); x < gui.area.W; x++ {
+		from, to := gui.columnBins(x, gui.area.W, len(values))
+		value := 0.0
+		for i := from; i < to; i++ {
+			value = math.Max(value, values[i])
 		}
+		columnRect := sdl.Rect{gui.area.X + x, gui.yOf(value), 1, 0}
+		columnRect.H = gui.area.Y + gui.area.H - columnRect.Y
+		gui.surface.FillRect(&columnRect, barColor)
 	}
-	scaleRect.Y = 0
-	scaleRect.W = gui.width / (int32)(bars)
-	scaleRect.H = gui.height
-	for x := -((int32)(gui.settings.from) % scale); x <= (int32)(bars); x += scale {
-		scaleRect.X = x * scaleRect.W
-		gui.surface.FillRect(&scaleRect, scaleColor)
-		gui.printAt(scaleRect, "%d", (int32)(gui.settings.from)+x)
+}
+
+func (gui *Gui) drawScales() {
+	if gui.settings.noteLabels {
+		gui.drawNoteScales()
+	} else {
+		gui.drawFrequencyScales()
+	}
+	if gui.settings.decibels {
+		gui.drawDecibelScales()
 	}
 }
 
@@ -177,21 +395,102 @@ func (gui *Gui) printAt(dst sdl.Rect, format string, args ...interface{}) sdl.Re
 }
 
 func (gui *Gui) printInfo(data *AggregatedData) {
+	lines := make([]string, 0)
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	add("Aggregate: %v", data.aggregate)
+	add("Threshold: %v", data.thresholdSettings)
+	add("Noise profile: %v", &data.noise)
+	if recorder != nil {
+		add("Recording: %v", recorder)
+	}
+	if player != nil {
+		add("Input: %v", player)
+	}
+	if replay != nil {
+		add("Replay: %v", replay)
+	}
+	add("Known tones: %v", data.tones)
+	if gui.editor.enabled {
+		gui.editor.checkSelection(data)
+		add("Editing: %v", &gui.editor)
+		add("  click peak: add/remove, [ ]: magnitude, tab: next tone, c: create, r: rename, u: undo, s: save")
+	}
+	add("Detected %v: %v", data.detector, data.detect())
+	if data.detector == detectorPoly {
+		for _, match := range data.tones.resolve(data) {
+			add("  %v", match)
+		}
+	}
+	if data.detector == detectorPitch {
+		add("Pitch: %v %v", data.pitch, noteOf(data.pitch.frequency, data.reference))
+	}
+	if fundamental, found := data.fundamental(); found {
+		add("Fundamental: %v %v", fundamental, noteOf(fundamental.frequency, data.reference))
+	}
+	add("Peaks: %d", len(data.peaks))
+	add("Partial tracks: %d", len(data.tracker.active))
+	add("Max peak: %v", data.maxPeak())
+	add("Top peaks:")
+	for _, peak := range data.topPeaks {
+		add("%v %v track %v", peak, noteOf(peak.frequency, data.reference), data.tracker.track(peak.track))
+	}
+	gui.printPanel(panelMargin, panelMargin, lines)
+}
+
+const panelMargin = 5
+
+// printPanel prints lines on a background sized by the text at x, y moved
+// to fit in the window. Lines which do not fit in the window are left out.
+func (gui *Gui) printPanel(x int32, y int32, lines []string) {
 	bgColor := sdl.Color{255, 10, 10, 10}.Uint32()
-	dst := sdl.Rect{5, 5, 200, 200}
+	lineHeight := (int32)(gui.font.Height())
+	maxLines := (int)((gui.height - 4*panelMargin) / lineHeight)
+	if maxLines <= 0 {
+		return
+	}
+	if len(lines) > maxLines {
+		lines = append(lines[:maxLines-1], "...")
+	}
+	var width int32
+	for _, line := range lines {
+		lineWidth, _, _ := gui.font.SizeUTF8(line)
+		width = (int32)(math.Max((float64)(width), (float64)(lineWidth)))
+	}
+	width = (int32)(math.Min((float64)(width), (float64)(gui.width-4*panelMargin)))
+	dst := sdl.Rect{x, y, width + 2*panelMargin, (int32)(len(lines))*lineHeight + 2*panelMargin}
+	dst.X = (int32)(math.Max(panelMargin, math.Min((float64)(dst.X), (float64)(gui.width-dst.W-panelMargin))))
+	dst.Y = (int32)(math.Max(panelMargin, math.Min((float64)(dst.Y), (float64)(gui.height-dst.H-panelMargin))))
 	gui.surface.FillRect(&dst, bgColor)
-	dst.X += 5
-	dst.Y += 5
-	dst = gui.printAt(dst, "Known tones: %v", data.tones)
-	dst = gui.printAt(dst, "Detected tones: %v", data.tones.detect(data))
-	dst = gui.printAt(dst, "Peaks: %d", len(data.peaks))
-	dst = gui.printAt(dst, "Max peak: %v", data.maxPeak())
-	dst = gui.printAt(dst, "Top peaks:")
-	for _, peak := range data.topPeaks {
-		dst = gui.printAt(dst, "%v", peak)
+	// cut lines too long for the window
+	gui.surface.SetClipRect(&dst)
+	defer gui.surface.SetClipRect(nil)
+	dst.X += panelMargin
+	dst.Y += panelMargin
+	for _, line := range lines {
+		dst = gui.printAt(dst, "%s", line)
 	}
 }
 
+func (gui *Gui) draw(data *AggregatedData, detected []string) {
+	gui.clear()
+	gui.drawWaterfall()
+	gui.drawScales()
+	if gui.area.H > 0 {
+		gui.drawThreshold(data)
+		gui.drawPeaks(data)
+		gui.drawBars(data)
+		if gui.showTemplates {
+			gui.drawTemplates(data)
+		}
+	}
+	gui.drawSelection()
+	gui.printInfo(data)
+	gui.drawLegend(data, detected)
+	gui.drawTooltip(data)
+}
+
 func (gui *Gui) flip() {
 	gui.window.UpdateSurface()
 }
@@ -199,37 +498,54 @@ func (gui *Gui) flip() {
 type Peak struct {
 	index int
 	value float64
+	// interpolated position of the peak
+	bin float64
+	frequency float64
+	// id of the partial track
+	track int
+}
+
+func (peak Peak) String() string {
+	return fmt.Sprintf("%.1f Hz (bin %.2f): %.2f", peak.frequency, peak.bin, peak.value)
 }
 
 type Tones map[string][]Peak
-func (tones *Tones) load(filename string) {
-	file, _ := os.Open(filename)
-	defer file.Close()
-	var toneName string
+func (tones *Tones) load(filename string, binFrequency float64) error {
 	*tones = make(Tones)
-	for {
-		peak := Peak{-1, math.Inf(-1)}
-		_, err := fmt.Fscanln(file, &toneName, &peak.index, &peak.value)
-		if err == io.EOF {
-			break
+	file, error := os.Open(filename)
+	if error != nil {
+		return error
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var toneName string
+		peak := Peak{index: -1, value: math.Inf(-1)}
+		n, _ := fmt.Sscan(scanner.Text(), &toneName, &peak.bin, &peak.value)
+		if n == 0 {
+			continue
 		}
+		if n == 1 {
+			// tone created by the editor without peaks
+			if _, found := (*tones)[toneName]; !found {
+				(*tones)[toneName] = []Peak{}
+			}
+			continue
+		}
+		peak.index = (int)(math.Round(peak.bin))
+		peak.frequency = peak.bin * binFrequency
 		(*tones)[toneName] = append((*tones)[toneName], peak)
 	}
+	return scanner.Err()
 }
 
 func (tones Tones) detect(data *AggregatedData) []string {
 	detected := make([]string, 0, len(tones))
 	for toneName, tone := range tones {
-		present := true
+		// newly created tones have no peaks yet
+		present := len(tone) > 0
 		for _, needPeak := range tone {
-			found := false
-			for _, peak := range data.peaks {
-				if peak.index == needPeak.index {
-					found = true
-					break
-				}
-			}
-			if ! found {
+			if data.findPeak(needPeak) < 0 {
 				present = false
 				break
 			}
@@ -249,25 +565,44 @@ type timestampedTones struct {
 }
 
 func (tones *timestampedTones) update(current string) bool {
-	ticks := sdl.GetTicks()
+	now := ticks()
 	if tones.recorded != current {
 		tones.recorded = current
-		tones.validUntil = ticks + toneTimeout
+		tones.validUntil = now + toneTimeout
 		return true
 	}
-	if ticks > tones.validUntil {
-		tones.validUntil = ticks + toneTimeout
+	if now > tones.validUntil {
+		tones.validUntil = now + toneTimeout
 		return true
 	}
 	return false
 }
 
 type AggregatedData struct {
+	// counter of the audio data when it was analyzed last time
+	frames int
 	values []float64
 	peaks []Peak
 	topPeaks []Peak
 	tones Tones
 	lastTones timestampedTones
+	aggregate Aggregate
+	emaDecay float64
+	threshold []float64
+	thresholdSettings ThresholdSettings
+	thresholdScratch []float64
+	interpolation Interpolation
+	binFrequency float64
+	toneTolerance float64
+	detector Detector
+	reference float64
+	pitchTracker PitchTracker
+	pitch Pitch
+	minClarity float64
+	polyMinEnergy float64
+	tracker PartialTracker
+	minSustain uint32
+	noise NoiseProfile
 }
 
 func (data *AggregatedData) init(options Options) {
@@ -275,6 +610,60 @@ func (data *AggregatedData) init(options Options) {
 	data.peaks = make([]Peak, 0, options.samples/2)
 	data.topPeaks = make([]Peak, 0, options.topPeaks)
 	data.tones = options.tones
+	data.aggregate = options.aggregate
+	data.emaDecay = options.emaDecay
+	data.threshold = make([]float64, options.samples/2)
+	data.thresholdSettings = options.threshold
+	data.thresholdScratch = make([]float64, options.samples/2)
+	data.interpolation = options.interpolation
+	data.binFrequency = options.binFrequency()
+	data.toneTolerance = options.toneTolerance
+	data.detector = options.detector
+	data.reference = options.reference
+	data.pitchTracker.init(options)
+	data.minClarity = options.minClarity
+	data.polyMinEnergy = options.polyMinEnergy
+	data.tracker.init(options)
+	data.minSustain = (uint32)(options.minSustain)
+	data.noise.init(options)
+	if options.calibrateNoise > 0 {
+		data.noise.calibrate(options.calibrateNoise)
+	} else if error := data.noise.load(options.noiseFile, options.samples/2); !os.IsNotExist(error) {
+		print_error(error)
+	}
+}
+
+// findPeak returns index of the detected peak closest to needPeak within
+// tone tolerance or -1 when there is none.
+func (data *AggregatedData) findPeak(needPeak Peak) int {
+	found := -1
+	distance := data.toneTolerance
+	for i, peak := range data.peaks {
+		if !data.sustained(peak) {
+			continue
+		}
+		if math.Abs(peak.bin - needPeak.bin) <= distance {
+			found = i
+			distance = math.Abs(peak.bin - needPeak.bin)
+		}
+	}
+	return found
+}
+
+func (data *AggregatedData) newPeak(index int) Peak {
+	bin, value := data.interpolation.interpolate(data.values, index)
+	return Peak{index: index, value: value, bin: bin, frequency: bin * data.binFrequency}
+}
+
+// newFrame returns true once for every frame pushed to src.
+func (data *AggregatedData) newFrame(src *AudioData) bool {
+	src.mux.Lock()
+	defer src.mux.Unlock()
+	if src.counter == data.frames {
+		return false
+	}
+	data.frames = src.counter
+	return true
 }
 
 func (data *AggregatedData) update(src *AudioData) {
@@ -283,19 +672,14 @@ func (data *AggregatedData) update(src *AudioData) {
 	defer recordData.mux.Unlock()
 	// process
 	for i, _ := range(data.values) {
-		data.values[i] = src.minMagnitudeAt(i)
+		data.values[i] = src.magnitudeAt(i, data.aggregate, data.emaDecay)
 	}
-}
-
-func (data *AggregatedData) avgValue() float64 {
-	var sum float64 = 0
-	for _, v := range data.values {
-		sum += v
+	if data.detector == detectorPitch {
+		data.pitch = data.pitchTracker.track(src.samples)
 	}
-	return sum / (float64)(len(data.values))
 }
 
-func (data *AggregatedData) updatePeaks(minPeakValue float64) {
+func (data *AggregatedData) updatePeaks() {
 	var peak Peak
 	var value float64
 	// delete peaks first
@@ -304,7 +688,7 @@ func (data *AggregatedData) updatePeaks(minPeakValue float64) {
 	prev := math.Inf(-1)
 	next := math.Inf(-1)
 	maxIndex := len(data.values)-1
-	minPeakValue = data.avgValue() * 5
+	data.updateThreshold()
 	for i := 1; i <= maxIndex; i++ {
 		value = data.values[i]
 		if i >= maxIndex {
@@ -312,9 +696,9 @@ func (data *AggregatedData) updatePeaks(minPeakValue float64) {
 		} else {
 			next = data.values[i+1]
 		}
-		if value >= minPeakValue && value > prev && value > next {
+		if value >= data.threshold[i] && value > prev && value > next {
 			// register peak
-			peak = Peak{i, value}
+			peak = data.newPeak(i)
 			data.peaks = append(data.peaks, peak)
 			// update top peaks
 			if len(data.topPeaks) == 0 {
@@ -352,30 +736,47 @@ func (data *AggregatedData) updatePeaks(minPeakValue float64) {
 		}
 		prev = value
 	}
+	// link peaks to partial tracks
+	data.tracker.update(data.peaks, ticks())
+	for i, topPeak := range data.topPeaks {
+		for _, peak := range data.peaks {
+			if peak.index == topPeak.index {
+				data.topPeaks[i].track = peak.track
+				break
+			}
+		}
+	}
 }
 
 func (data *AggregatedData) maxPeak() Peak {
 	if len(data.topPeaks) == 0 {
-		return Peak{-1, math.Inf(-1)}
+		return Peak{index: -1, value: math.Inf(-1)}
 	}
 	return data.topPeaks[len(data.topPeaks)-1]
 }
 
 type AudioData struct {
 	mux sync.Mutex
-	values[] *fftw.Array
+	values [][]complex128
 	size int
 	counter int
 	device sdl.AudioDeviceID
+	fft FFT
+	scratch []float64
+	// time domain samples of the last record
+	samples []float64
 }
 
 func (data *AudioData) init(options Options) {
 	data.size = options.historySize
 	data.counter = 0
-	data.values = make([]*fftw.Array, data.size)
+	data.values = make([][]complex128, data.size)
 	for i := 0; i < data.size; i++ {
-		data.values[i] = fftw.NewArray(options.samples)
+		data.values[i] = make([]complex128, options.samples)
 	}
+	data.fft = newFFT(options.samples)
+	data.scratch = make([]float64, data.size)
+	data.samples = make([]float64, options.samples)
 }
 
 const dataFormat = sdl.AUDIO_F32SYS
@@ -396,18 +797,36 @@ func (data *AudioData) openRecordDevice(options Options) error {
 	return error
 }
 
+// latestMagnitudes stores magnitudes of the newest spectrum to values.
+func (data *AudioData) latestMagnitudes(values []float64) {
+	data.mux.Lock()
+	defer data.mux.Unlock()
+	newest := data.values[(data.counter-1+data.size) % data.size]
+	for i := range values {
+		values[i] = magnitude(newest[i])
+	}
+}
+
 func (data *AudioData) minMagnitudeAt(index int) float64 {
 	var min float64 = math.Inf(1)
 	for j := 0; j < data.size; j++ {
-		min = math.Min(magnitude(data.values[j].Elems[index]), min)
+		min = math.Min(magnitude(data.values[j][index]), min)
 	}
 	return (float64)(min)
 }
 
+func (data *AudioData) maxMagnitudeAt(index int) float64 {
+	var max float64 = 0
+	for j := 0; j < data.size; j++ {
+		max = math.Max(magnitude(data.values[j][index]), max)
+	}
+	return max
+}
+
 func (data *AudioData) sumMagnitudeAt(index int) float64 {
 	var sum float64 = 0
 	for j := 0; j < data.size; j++ {
-		sum += magnitude(data.values[j].Elems[index])
+		sum += magnitude(data.values[j][index])
 	}
 	return (float64)(sum)
 }
@@ -416,23 +835,52 @@ func (data *AudioData) avgMagnitudeAt(index int) float64 {
 	return data.sumMagnitudeAt(index) / (float64)(data.size)
 }
 
+func (data *AudioData) medianMagnitudeAt(index int) float64 {
+	for j := 0; j < data.size; j++ {
+		data.scratch[j] = magnitude(data.values[j][index])
+	}
+	return median(data.scratch)
+}
+
+// emaMagnitudeAt walks the history from the oldest to the newest record,
+// decay is the weight kept from the previous records on every step.
+func (data *AudioData) emaMagnitudeAt(index int, decay float64) float64 {
+	oldest := data.counter % data.size
+	ema := magnitude(data.values[oldest][index])
+	for j := 1; j < data.size; j++ {
+		value := magnitude(data.values[(oldest+j)%data.size][index])
+		ema = decay*ema + (1-decay)*value
+	}
+	return ema
+}
+
 //export recordCallback
 func recordCallback(userdata unsafe.Pointer, stream *C.Uint8, length C.int) {
-	// locks
-	recordData.mux.Lock()
-	defer recordData.mux.Unlock()
-	// continue with code
-	index := recordData.counter % recordData.size
 	dataSlice := (*[1<<30]float32)(unsafe.Pointer(stream))[:length/dataByteSize:length/dataByteSize]
-	for i := 0; i < (int)(length/dataByteSize); i++ {
-		recordData.values[index].Elems[i] = (complex128)(complex(dataSlice[i], 0))
+	recordData.push(dataSlice)
+	if recorder != nil {
+		recorder.add(dataSlice)
 	}
-	fftw.FFTTo(recordData.values[index], recordData.values[index])
-	recordData.counter++
 	//fmt.Printf("Data: %v\n", recordData.values.Elems)
 	//fmt.Printf("Test: %v\n", recordData.counter)
 }
 
+// push adds spectrum of the samples captured by the device or read from
+// the input file to the history.
+func (data *AudioData) push(samples []float32) {
+	// locks
+	data.mux.Lock()
+	defer data.mux.Unlock()
+	// continue with code
+	values := data.values[data.counter % data.size]
+	for i := range samples {
+		values[i] = (complex128)(complex(samples[i], 0))
+		data.samples[i] = (float64)(samples[i])
+	}
+	data.fft.transform(values)
+	data.counter++
+}
+
 func magnitude(item complex128) float64 {
 	return math.Sqrt((float64)(real(item)*real(item) + imag(item)*imag(item)))
 }
@@ -458,7 +906,24 @@ func parseArgs(options *Options) {
 		&options.interval, "interval", 10, "Analyze and draw interval",
 	)
 	flag.Float64Var(
-		&options.minPeakValue, "min-peak-value", 0.5, "Minimal value to be considered as peak",
+		&options.threshold.minValue, "min-peak-value", 0.5, "Minimal value to be considered as peak",
+	)
+	options.threshold.strategy = thresholdMean
+	flag.Var(
+		&options.threshold.strategy, "threshold",
+		"How the peak threshold is computed, one of: "+strings.Join(thresholdNames, ", "),
+	)
+	flag.Float64Var(
+		&options.threshold.factor, "threshold-factor", 5,
+		"Multiple of mean or median used by the threshold",
+	)
+	flag.Float64Var(
+		&options.threshold.percentile, "threshold-percentile", 95,
+		"Percentile used by the percentile threshold",
+	)
+	flag.IntVar(
+		&options.threshold.bands, "threshold-bands", 16,
+		"Number of bands used by the band threshold",
 	)
 	flag.IntVar(
 		&options.topPeaks, "top-peaks", 5, "Number of top peaks taken in account",
@@ -466,8 +931,157 @@ func parseArgs(options *Options) {
 	flag.StringVar(
 		&options.toneFile, "tone-file", "config.txt", "File storing tone configuration",
 	)
+	flag.Var(
+		&options.aggregate, "aggregate",
+		"How history is aggregated, one of: "+strings.Join(aggregateNames, ", "),
+	)
+	flag.Float64Var(
+		&options.emaDecay, "ema-decay", 0.5,
+		"Weight of previous results when aggregating using ema",
+	)
+	options.interpolation = interpolationParabolic
+	flag.Var(
+		&options.interpolation, "interpolation",
+		"How the peak position is interpolated, one of: "+strings.Join(interpolationNames, ", "),
+	)
+	flag.Float64Var(
+		&options.toneTolerance, "tone-tolerance", 0.5,
+		"Maximal distance (in bins) of a peak from the configured one",
+	)
+	flag.Var(
+		&options.detector, "detector",
+		"What is reported as detected, one of: "+strings.Join(detectorNames, ", "),
+	)
+	flag.Float64Var(
+		&options.reference, "a4", 440, "Reference pitch of A4 in Hz used for note names",
+	)
+	flag.Float64Var(
+		&options.pitchThreshold, "pitch-threshold", 0.15,
+		"YIN threshold of the pitch detector",
+	)
+	flag.Float64Var(
+		&options.minPitch, "min-pitch", 80, "Lowest frequency in Hz detected by the pitch detector",
+	)
+	flag.Float64Var(
+		&options.maxPitch, "max-pitch", 4000, "Highest frequency in Hz detected by the pitch detector",
+	)
+	flag.Float64Var(
+		&options.minClarity, "min-clarity", 0.85,
+		"Minimal clarity of pitch reported by the pitch detector",
+	)
+	flag.Float64Var(
+		&options.polyMinEnergy, "poly-min-energy", 0.1,
+		"Minimal part of peak energy a tone has to explain to be detected by the poly detector",
+	)
+	flag.Float64Var(
+		&options.trackTolerance, "track-tolerance", 1,
+		"Maximal change (in bins) of a partial between two frames",
+	)
+	flag.IntVar(
+		&options.trackGap, "track-gap", 100,
+		"Time (in ms) a partial track survives without a peak",
+	)
+	flag.IntVar(
+		&options.minSustain, "min-sustain", 0,
+		"Minimal time (in ms) a partial has to last to be used for detection",
+	)
+	flag.Float64Var(
+		&options.calibrateNoise, "calibrate-noise", 0,
+		"Capture background noise profile for given number of seconds first",
+	)
+	flag.StringVar(
+		&options.noiseFile, "noise-file", "",
+		"File storing the noise profile (defaults to tone file with .noise suffix)",
+	)
+	flag.Float64Var(
+		&options.noiseFactor, "noise-factor", 1, "Multiple of noise profile subtracted from values",
+	)
+	flag.BoolVar(
+		&options.decibels, "db", false, "Show magnitude in decibels",
+	)
+	flag.Float64Var(
+		&options.dbFloor, "db-floor", 80,
+		"Lowest magnitude shown in decibels (in dB below the top of the view)",
+	)
+	flag.BoolVar(
+		&options.logFrequency, "log-frequency", false, "Show frequency on logarithmic axis",
+	)
+	flag.BoolVar(
+		&options.noteLabels, "note-labels", false, "Label frequency axis by note names",
+	)
+	flag.Var(
+		&options.view, "view",
+		"Panels shown in debug mode, one of: "+strings.Join(viewNames, ", "),
+	)
+	flag.Float64Var(
+		&options.waterfallSeconds, "waterfall-seconds", 5, "Time span of the waterfall in seconds",
+	)
+	flag.IntVar(
+		&options.width, "width", 2048, "Initial width of the debug window",
+	)
+	flag.IntVar(
+		&options.height, "height", 1000, "Initial height of the debug window",
+	)
+	flag.StringVar(
+		&options.input, "input", "", "WAV file analyzed instead of the captured sound",
+	)
+	flag.StringVar(
+		&options.record, "record", "", "Record the captured sound to this WAV file",
+	)
+	flag.Float64Var(
+		&options.recordBuffer, "record-buffer", 0,
+		"Keep the last SECONDS of the captured sound to be saved on demand",
+	)
+	flag.StringVar(
+		&options.dump, "dump", "",
+		"Write spectrum, values, peaks and detected tones of every analyzed frame to this file",
+	)
+	flag.StringVar(
+		&options.replay, "replay", "", "Replay frames of a -dump file instead of analyzing sound",
+	)
+	flag.StringVar(
+		&options.render, "render", "",
+		"Render the view of the -input file to this PNG file without a window and exit",
+	)
+	flag.Float64Var(
+		&options.renderAt, "render-at", -1,
+		"Time in the -input file in seconds rendered by -render (default is the end)",
+	)
 	flag.Parse()
-	options.tones.load(options.toneFile)
+	if options.emaDecay <= 0 || options.emaDecay >= 1 {
+		usageError("-ema-decay has to be between 0 and 1")
+	}
+	if options.dbFloor == 0 {
+		usageError("-db-floor can not be 0")
+	}
+	if options.noiseFile == "" {
+		options.noiseFile = options.toneFile + ".noise"
+	}
+	options.toneError = options.tones.load(options.toneFile, options.binFrequency())
+	// the editor may start without the tone file and create it
+	if options.toneError != nil && !(options.tune && os.IsNotExist(options.toneError)) {
+		print_error(options.toneError)
+		os.Exit(1)
+	}
+}
+
+// usageError reports invalid option values like the flag package does.
+func usageError(message string) {
+	fmt.Fprintf(flag.CommandLine.Output(), "%s\n", message)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// simulated time in milliseconds used instead of the SDL ticks when an
+// input file is processed
+var simulatedTicks uint32
+var simulating bool
+
+func ticks() uint32 {
+	if simulating {
+		return simulatedTicks
+	}
+	return sdl.GetTicks()
 }
 
 func print_error(error error) {
@@ -483,7 +1097,7 @@ func init_sdl(options Options, gui *Gui) {
 		print_error(error)
 		gui.window, error = sdl.CreateWindow(
 			"analyzer", sdl.WINDOWPOS_CENTERED, sdl.WINDOWPOS_CENTERED,
-			gui.width, gui.height, 0,
+			gui.width, gui.height, sdl.WINDOW_RESIZABLE,
 		)
 		print_error(error)
 		gui.surface, error = gui.window.GetSurface()
@@ -498,8 +1112,38 @@ func init_sdl(options Options, gui *Gui) {
 		error = sdl.Init(sdl.INIT_AUDIO)
 		print_error(error)
 	}
-	error = recordData.openRecordDevice(options)
-	print_error(error)
+	if options.input == "" && options.replay == "" {
+		error = recordData.openRecordDevice(options)
+		print_error(error)
+	}
+}
+
+// analyze detects tones in the newest frame of recordData and reports them.
+func (gui *Gui) analyze(options Options, data *AggregatedData) []string {
+	data.update(recordData)
+	data.updateNoise()
+	data.updatePeaks()
+	detected := data.detect()
+	gui.report(options, data, detected)
+	return detected
+}
+
+// report prints changes of the detected tones, adds them to the waterfall
+// and dumps the analyzed frame.
+func (gui *Gui) report(options Options, data *AggregatedData, detected []string) {
+	if !options.tune && !data.noise.calibrating && data.lastTones.update(fmt.Sprintf("%v", detected)) {
+		fmt.Printf("%v\n", data.lastTones.recorded)
+	}
+	if options.debug || options.tune {
+		gui.waterfall.push(data, detected)
+	}
+	if dumpWriter != nil {
+		if error := dumpWriter.write(data, recordData, detected); error != nil {
+			print_error(error)
+			dumpWriter.close()
+			dumpWriter = nil
+		}
+	}
 }
 
 func mainloop(options Options, gui *Gui) {
@@ -508,7 +1152,10 @@ func mainloop(options Options, gui *Gui) {
 	currentData := new(AggregatedData)
 	// start capturing data
 	currentData.init(options)
-	sdl.PauseAudioDevice(recordData.device, !capturing)
+	detected := make([]string, 0)
+	if recordData.device != 0 {
+		sdl.PauseAudioDevice(recordData.device, !capturing)
+	}
 	for running {
 		// process events
 		sdl.PumpEvents()
@@ -517,7 +1164,23 @@ func mainloop(options Options, gui *Gui) {
 			case *sdl.QuitEvent:
 				running = false
 				break
+			case *sdl.WindowEvent:
+				if t.Event == sdl.WINDOWEVENT_SIZE_CHANGED {
+					gui.resize(t.Data1, t.Data2)
+				}
+			case *sdl.MouseMotionEvent, *sdl.MouseButtonEvent, *sdl.MouseWheelEvent:
+				gui.handleMouse(event, currentData)
+			case *sdl.TextInputEvent:
+				if gui.editor.typing {
+					gui.editor.typeText(t.GetText())
+				}
 			case *sdl.KeyboardEvent:
+				if gui.editor.typing {
+					if t.State == sdl.RELEASED {
+						gui.editor.typeKey(currentData, t.Keysym.Sym)
+					}
+					break
+				}
 				switch t.State {
 				case sdl.RELEASED:
 					switch t.Keysym.Sym {
@@ -543,8 +1206,46 @@ func mainloop(options Options, gui *Gui) {
 						running = false
 					case sdl.K_SPACE:
 						capturing = !capturing
-						sdl.PauseAudioDevice(recordData.device, !capturing)
+						if recordData.device != 0 {
+							sdl.PauseAudioDevice(recordData.device, !capturing)
+						}
+						if player != nil {
+							player.pause()
+						}
+					case sdl.K_a:
+						currentData.aggregate = currentData.aggregate.next()
+					case sdl.K_t:
+						currentData.thresholdSettings.strategy = currentData.thresholdSettings.strategy.next()
+					case sdl.K_n:
+						currentData.noise.calibrate(options.noiseCalibrationTime())
+					case sdl.K_d:
+						gui.settings.decibels = !gui.settings.decibels
+					case sdl.K_l:
+						gui.settings.logFrequency = !gui.settings.logFrequency
+					case sdl.K_g:
+						gui.settings.noteLabels = !gui.settings.noteLabels
+					case sdl.K_w:
+						gui.view = gui.view.next()
+						gui.layout()
+					case sdl.K_o:
+						gui.showTemplates = !gui.showTemplates
+					case sdl.K_p:
+						gui.saveScreenshot()
+					case sdl.K_F2:
+						if recorder != nil {
+							recorder.toggle()
+						}
+					case sdl.K_F3:
+						if recorder != nil {
+							recorder.dump()
+						}
 					default:
+						if gui.editor.enabled && gui.handleEditorKey(currentData, t.Keysym.Sym) {
+							break
+						}
+						if gui.showTemplates && gui.toggleToneKey(currentData, t.Keysym.Sym) {
+							break
+						}
 						fmt.Fprintf(os.Stderr, "Unhanled key: '%s'\n", string(t.Keysym.Sym))
 					}
 					break
@@ -552,30 +1253,51 @@ func mainloop(options Options, gui *Gui) {
 				break
 			}
 		}
-		// calculate and display if capturing data
-		if capturing {
-			currentData.update(recordData)
-			currentData.updatePeaks(options.minPeakValue)
-			if !options.tune && currentData.lastTones.update(fmt.Sprintf("%v", currentData.tones.detect(currentData))) {
-				fmt.Printf("%v\n", currentData.lastTones.recorded)
+		// calculate if capturing data, every frame only once
+		if capturing && player != nil {
+			// play the input file at the rate of the capture whatever
+			// the loop interval is
+			for capturing && player.due() {
+				if player.next(recordData) {
+					detected = gui.analyze(options, currentData)
+				} else {
+					fmt.Fprintf(os.Stderr, "End of %s\n", player.filename)
+					capturing = false
+					running = options.debug || options.tune
+				}
+			}
+		} else if capturing && replay != nil {
+			replayed, error := replay.next(currentData)
+			if error != nil {
+				if error != io.EOF {
+					print_error(error)
+				}
+				fmt.Fprintf(os.Stderr, "End of %s\n", replay.filename)
+				capturing = false
+				running = options.debug || options.tune
+			} else {
+				detected = replayed
+				gui.report(options, currentData, detected)
 			}
+		} else if capturing && currentData.newFrame(recordData) {
+			detected = gui.analyze(options, currentData)
 		}
 		// display when in debug mode
 		if options.debug || options.tune {
-			gui.clear()
-			gui.drawScales()
-			gui.drawPeaks(currentData)
-			gui.drawBars(currentData)
-			gui.printInfo(currentData)
+			gui.draw(currentData, detected)
 			gui.flip()
 		}
 		if !options.tune {
 			
 		}
-		sdl.Delay((uint32)(options.interval))
+		if replay != nil {
+			sdl.Delay(replay.delay)
+		} else {
+			sdl.Delay((uint32)(options.interval))
+		}
 	}
 	// stop capturing data
-	if capturing {
+	if capturing && recordData.device != 0 {
 		sdl.PauseAudioDevice(recordData.device, true)
 	}
 	fmt.Fprintf(os.Stderr, "END LOOP\n")
@@ -586,14 +1308,65 @@ var recordData *AudioData
 func main() {
 	var options Options
 	var gui Gui
-	gui.width = 2048
-	gui.height = 1000
 	parseArgs(&options)
+	gui.width = (int32)(options.width)
+	gui.height = (int32)(options.height)
 	fmt.Fprintf(os.Stderr, "Options: %v\n", options)
-	gui.settings.init(options.samples/2-1)
+	fmt.Fprintf(os.Stderr, "FFT backend: %s\n", fftBackend)
+	gui.settings.init(options)
+	gui.view = options.view
+	gui.showTemplates = true
+	gui.editor.init(options)
+	gui.layout()
+	gui.waterfall.init(options)
 	recordData = new(AudioData)
 	recordData.init(options)
+	if options.input != "" {
+		var error error
+		if player, error = newPlayer(options); error != nil {
+			print_error(error)
+			os.Exit(1)
+		}
+	}
+	if options.replay != "" {
+		var error error
+		if replay, error = openDump(options.replay, options); error != nil {
+			print_error(error)
+			os.Exit(1)
+		}
+		defer replay.close()
+	}
+	if options.dump != "" {
+		var error error
+		// rendering does not analyze frames to dump and a replayed dump
+		// has no magnitudes of its own
+		if options.render != "" || options.replay != "" {
+			print_error(errors.New("-dump can not be combined with -render or -replay."))
+			os.Exit(1)
+		}
+		if dumpWriter, error = createDump(options.dump, options); error != nil {
+			print_error(error)
+			os.Exit(1)
+		}
+	}
+	if options.render != "" {
+		if error := renderFile(options, &gui); error != nil {
+			print_error(error)
+			os.Exit(1)
+		}
+		return
+	}
+	if options.input == "" && options.replay == "" {
+		recorder = new(Recorder)
+		recorder.init(options)
+	}
 	init_sdl(options, &gui)
 	mainloop(options, &gui)
+	if recorder != nil {
+		recorder.stop()
+	}
+	if dumpWriter != nil {
+		print_error(dumpWriter.close())
+	}
 	sdl.Quit()
 }
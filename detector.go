@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Detector selects what is reported as detected tones.
+type Detector int
+
+const (
+	// tones configured in the tone file
+	detectorTones Detector = iota
+	// equal-tempered note of the estimated fundamental
+	detectorNotes
+	// equal-tempered note of the time domain pitch
+	detectorPitch
+	// smallest set of tones from the tone file explaining the peaks
+	detectorPoly
+)
+
+var detectorNames = []string{"tones", "notes", "pitch", "poly"}
+
+func (detector Detector) String() string {
+	return detectorNames[detector]
+}
+
+func (detector *Detector) Set(value string) error {
+	for i, name := range detectorNames {
+		if name == value {
+			*detector = (Detector)(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown detector %q, expected one of: %s", value, strings.Join(detectorNames, ", "))
+}
+
+func (data *AggregatedData) detect() []string {
+	switch data.detector {
+	case detectorNotes:
+		return data.detectNotes()
+	case detectorPitch:
+		return data.detectPitch()
+	case detectorPoly:
+		return data.detectPoly()
+	}
+	return data.tones.detect(data)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The frame dump starts by a text line with the magic word, the format
+// version and key=value pairs describing the analysis. Every analyzed
+// frame follows, all numbers are little endian:
+//   uint32 time in ms
+//   float32 x bins magnitudes of the newest FFT frame
+//   float32 x bins aggregated values the peaks are searched in
+//   uint32 number of peaks, float32 bin and float32 value of every peak
+//   uint32 length of the detected tones joined by spaces, the tones
+const dumpMagic = "xylophone-dump"
+const dumpVersion = 1
+
+// no window function is applied before the FFT
+const dumpWindow = "rectangular"
+
+type DumpWriter struct {
+	file *os.File
+	writer *bufio.Writer
+	magnitudes []float64
+	// the first write error, returned by write
+	error error
+}
+
+var dumpWriter *DumpWriter
+
+func createDump(filename string, options Options) (*DumpWriter, error) {
+	file, error := os.Create(filename)
+	if error != nil {
+		return nil, error
+	}
+	dump := &DumpWriter{file, bufio.NewWriter(file), make([]float64, options.samples/2), nil}
+	fmt.Fprintf(
+		dump.writer, "%s %d rate=%d fft=%d bins=%d window=%s aggregate=%v detector=%v\n",
+		dumpMagic, dumpVersion, options.frequency, options.samples, options.samples/2,
+		dumpWindow, options.aggregate, options.detector,
+	)
+	return dump, nil
+}
+
+func (dump *DumpWriter) writeValue(value interface{}) {
+	if dump.error == nil {
+		dump.error = binary.Write(dump.writer, binary.LittleEndian, value)
+	}
+}
+
+func (dump *DumpWriter) writeValues(values []float64) {
+	for _, value := range values {
+		dump.writeValue((float32)(value))
+	}
+}
+
+func (dump *DumpWriter) write(data *AggregatedData, src *AudioData, detected []string) error {
+	src.latestMagnitudes(dump.magnitudes)
+	dump.writeValue(ticks())
+	dump.writeValues(dump.magnitudes)
+	dump.writeValues(data.values)
+	dump.writeValue((uint32)(len(data.peaks)))
+	for _, peak := range data.peaks {
+		dump.writeValue((float32)(peak.bin))
+		dump.writeValue((float32)(peak.value))
+	}
+	tones := strings.Join(detected, " ")
+	dump.writeValue((uint32)(len(tones)))
+	dump.writeValue([]byte(tones))
+	return dump.error
+}
+
+func (dump *DumpWriter) close() error {
+	if error := dump.writer.Flush(); error != nil {
+		dump.file.Close()
+		return error
+	}
+	return dump.file.Close()
+}
+
+// DumpReader replays frames of a dump instead of analyzing captured sound.
+type DumpReader struct {
+	filename string
+	file *os.File
+	reader *bufio.Reader
+	header map[string]string
+	bins int
+	frames int
+	// time to the next frame in ms
+	delay uint32
+	buffer []float32
+}
+
+var replay *DumpReader
+
+func openDump(filename string, options Options) (*DumpReader, error) {
+	file, error := os.Open(filename)
+	if error != nil {
+		return nil, error
+	}
+	dump := &DumpReader{filename: filename, file: file, reader: bufio.NewReader(file), header: make(map[string]string)}
+	line, error := dump.reader.ReadString('\n')
+	fields := strings.Fields(line)
+	if error != nil || len(fields) < 2 || fields[0] != dumpMagic {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a frame dump", filename)
+	}
+	if fields[1] != strconv.Itoa(dumpVersion) {
+		file.Close()
+		return nil, fmt.Errorf("unsupported version %s of frame dump %s", fields[1], filename)
+	}
+	for _, field := range fields[2:] {
+		if pair := strings.SplitN(field, "=", 2); len(pair) == 2 {
+			dump.header[pair[0]] = pair[1]
+		}
+	}
+	// the dump has to match arrays allocated by the options
+	if dump.header["rate"] != strconv.Itoa(options.frequency) {
+		file.Close()
+		return nil, fmt.Errorf("%s was captured at %s Hz, use -frequency %s", filename, dump.header["rate"], dump.header["rate"])
+	}
+	if dump.header["fft"] != strconv.Itoa(options.samples) {
+		file.Close()
+		return nil, fmt.Errorf("%s has FFT size %s, use -samples %s", filename, dump.header["fft"], dump.header["fft"])
+	}
+	dump.bins = options.samples / 2
+	dump.buffer = make([]float32, dump.bins)
+	return dump, nil
+}
+
+func (dump *DumpReader) readValue(value interface{}) error {
+	return binary.Read(dump.reader, binary.LittleEndian, value)
+}
+
+func (dump *DumpReader) readValues(values []float64) error {
+	if error := dump.readValue(dump.buffer); error != nil {
+		return error
+	}
+	for i, value := range dump.buffer {
+		values[i] = (float64)(value)
+	}
+	return nil
+}
+
+// next loads the next frame to data and returns its detected tones. It
+// returns io.EOF at the end of the dump.
+func (dump *DumpReader) next(data *AggregatedData) ([]string, error) {
+	var frameTicks, count uint32
+	if error := dump.readValue(&frameTicks); error != nil {
+		return nil, error
+	}
+	// the magnitudes are not used by the analysis, only the values are
+	if error := dump.readValue(dump.buffer); error != nil {
+		return nil, unexpected(error)
+	}
+	if error := dump.readValues(data.values); error != nil {
+		return nil, unexpected(error)
+	}
+	if error := dump.readValue(&count); error != nil {
+		return nil, unexpected(error)
+	}
+	if count > (uint32)(dump.bins) {
+		return nil, errors.New("Corrupted frame dump.")
+	}
+	data.peaks = data.peaks[:0]
+	for i := (uint32)(0); i < count; i++ {
+		var bin, value float32
+		if error := dump.readValue(&bin); error != nil {
+			return nil, unexpected(error)
+		}
+		if error := dump.readValue(&value); error != nil {
+			return nil, unexpected(error)
+		}
+		data.peaks = append(data.peaks, Peak{
+			index: (int)(math.Round((float64)(bin))),
+			value: (float64)(value),
+			bin: (float64)(bin),
+			frequency: (float64)(bin) * data.binFrequency,
+		})
+	}
+	if error := dump.readValue(&count); error != nil {
+		return nil, unexpected(error)
+	}
+	tones := make([]byte, count)
+	if _, error := io.ReadFull(dump.reader, tones); error != nil {
+		return nil, unexpected(error)
+	}
+	if dump.frames > 0 && frameTicks > simulatedTicks {
+		dump.delay = frameTicks - simulatedTicks
+	}
+	dump.frames++
+	simulating = true
+	simulatedTicks = frameTicks
+	data.replayed()
+	return strings.Fields(string(tones)), nil
+}
+
+// unexpected reports end of file inside of a frame as an error.
+func unexpected(error error) error {
+	if error == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return error
+}
+
+// replayed recomputes what is drawn but not stored in the dump.
+func (data *AggregatedData) replayed() {
+	data.updateThreshold()
+	data.tracker.update(data.peaks, ticks())
+	// the highest peaks, the lowest of them first
+	sorted := append([]Peak(nil), data.peaks...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].value < sorted[j].value
+	})
+	if limit := cap(data.topPeaks); len(sorted) > limit {
+		sorted = sorted[len(sorted)-limit:]
+	}
+	data.topPeaks = append(data.topPeaks[:0], sorted...)
+}
+
+func (dump *DumpReader) String() string {
+	return fmt.Sprintf("%s frame %d (%.1f s)", dump.filename, dump.frames, (float64)(simulatedTicks)/1000)
+}
+
+func (dump *DumpReader) close() error {
+	return dump.file.Close()
+}
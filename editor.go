@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// clicks closer than pickDistance pixels to a peak pick it
+const pickDistance = markerSize
+
+// maximal number of remembered edits
+const maxUndo = 100
+
+// magnitude change of one press of [ or ]
+const magnitudeStep = 1.1
+
+type editorSnapshot struct {
+	tones Tones
+	selected string
+}
+
+// ToneEditor edits the tone configuration in tune mode.
+type ToneEditor struct {
+	enabled bool
+	filename string
+	selected string
+	modified bool
+	history []editorSnapshot
+	// name of a new or renamed tone being typed
+	typing bool
+	renaming bool
+	input string
+}
+
+func (editor *ToneEditor) init(options Options) {
+	editor.enabled = options.tune
+	editor.filename = options.toneFile
+	if editor.enabled && options.toneError != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read %s (%v), it is created on save\n", editor.filename, options.toneError)
+	}
+}
+
+func (editor *ToneEditor) String() string {
+	if editor.typing {
+		if editor.renaming {
+			return fmt.Sprintf("rename %s to: %s_", editor.selected, editor.input)
+		}
+		return fmt.Sprintf("new tone: %s_", editor.input)
+	}
+	if editor.selected == "" {
+		return "no tone, press c to create one"
+	}
+	modified := ""
+	if editor.modified {
+		modified = ", modified"
+	}
+	return fmt.Sprintf("%s%s", editor.selected, modified)
+}
+
+func (tones Tones) clone() Tones {
+	clone := make(Tones, len(tones))
+	for name, tone := range tones {
+		clone[name] = append([]Peak(nil), tone...)
+	}
+	return clone
+}
+
+func (tones Tones) save(filename string) error {
+	file, error := os.Create(filename)
+	if error != nil {
+		return error
+	}
+	writer := bufio.NewWriter(file)
+	for _, name := range tones.names() {
+		// a tone without peaks is kept by a line with its name only
+		if len(tones[name]) == 0 {
+			fmt.Fprintf(writer, "%s\n", name)
+		}
+		for _, peak := range tones[name] {
+			fmt.Fprintf(writer, "%s %g %g\n", name, peak.bin, peak.value)
+		}
+	}
+	if error = writer.Flush(); error != nil {
+		file.Close()
+		return error
+	}
+	return file.Close()
+}
+
+// checkSelection selects the first tone when the selected one is gone.
+func (editor *ToneEditor) checkSelection(data *AggregatedData) {
+	if _, found := data.tones[editor.selected]; found {
+		return
+	}
+	editor.selected = ""
+	if names := data.tones.names(); len(names) > 0 {
+		editor.selected = names[0]
+	}
+}
+
+// remember stores the tones before they are changed.
+func (editor *ToneEditor) remember(data *AggregatedData) {
+	if len(editor.history) == maxUndo {
+		editor.history = editor.history[1:]
+	}
+	editor.history = append(editor.history, editorSnapshot{data.tones.clone(), editor.selected})
+	editor.modified = true
+}
+
+func (editor *ToneEditor) undo(data *AggregatedData) {
+	if len(editor.history) == 0 {
+		return
+	}
+	last := editor.history[len(editor.history)-1]
+	editor.history = editor.history[:len(editor.history)-1]
+	data.tones = last.tones
+	editor.selected = last.selected
+	editor.modified = true
+}
+
+func (editor *ToneEditor) save(data *AggregatedData) {
+	if error := data.tones.save(editor.filename); error != nil {
+		print_error(error)
+	} else {
+		editor.modified = false
+		fmt.Fprintf(os.Stderr, "Tones saved to %s\n", editor.filename)
+	}
+}
+
+// nearestPeak returns index of the peak closest to x which is not further
+// than maxDistance pixels or -1.
+func (gui *Gui) nearestPeak(peaks []Peak, x int32, maxDistance float64) int {
+	found := -1
+	for i, peak := range peaks {
+		distance := math.Abs((float64)(gui.xOf(peak.bin) - x))
+		if distance <= maxDistance {
+			found = i
+			maxDistance = distance
+		}
+	}
+	return found
+}
+
+// editPeak removes the peak of the selected tone at x or adds the detected
+// peak at x to it. It returns false when there is no peak to edit.
+func (gui *Gui) editPeak(data *AggregatedData, x int32, y int32) bool {
+	editor := &gui.editor
+	point := sdl.Point{x, y}
+	if !editor.enabled || editor.typing || editor.selected == "" || !point.InRect(&gui.area) {
+		return false
+	}
+	tone := data.tones[editor.selected]
+	if found := gui.nearestPeak(tone, x, pickDistance); found >= 0 {
+		editor.remember(data)
+		data.tones[editor.selected] = append(tone[:found:found], tone[found+1:]...)
+		return true
+	}
+	if found := gui.nearestPeak(data.peaks, x, pickDistance); found >= 0 {
+		peak := data.peaks[found]
+		editor.remember(data)
+		tone = append(tone[:len(tone):len(tone)], Peak{index: peak.index, value: peak.value, bin: peak.bin, frequency: peak.frequency})
+		sort.Slice(tone, func(i, j int) bool {
+			return tone[i].bin < tone[j].bin
+		})
+		data.tones[editor.selected] = tone
+		return true
+	}
+	return false
+}
+
+// scaleMagnitude multiplies magnitude of the peak of the selected tone
+// closest to the mouse cursor.
+func (gui *Gui) scaleMagnitude(data *AggregatedData, factor float64) {
+	editor := &gui.editor
+	tone := data.tones[editor.selected]
+	found := gui.nearestPeak(tone, gui.mouse.x, math.Inf(1))
+	if found < 0 {
+		return
+	}
+	editor.remember(data)
+	data.tones[editor.selected] = append([]Peak(nil), tone...)
+	data.tones[editor.selected][found].value *= factor
+}
+
+// handleEditorKey handles keys of the editor, it returns false for other keys.
+func (gui *Gui) handleEditorKey(data *AggregatedData, key sdl.Keycode) bool {
+	editor := &gui.editor
+	editor.checkSelection(data)
+	switch key {
+	case sdl.K_TAB:
+		names := data.tones.names()
+		for i, name := range names {
+			if name == editor.selected {
+				editor.selected = names[(i+1)%len(names)]
+				break
+			}
+		}
+	case sdl.K_c:
+		editor.startTyping(false, "")
+	case sdl.K_r:
+		if editor.selected != "" {
+			editor.startTyping(true, editor.selected)
+		}
+	case sdl.K_LEFTBRACKET:
+		gui.scaleMagnitude(data, 1/magnitudeStep)
+	case sdl.K_RIGHTBRACKET:
+		gui.scaleMagnitude(data, magnitudeStep)
+	case sdl.K_u:
+		editor.undo(data)
+	case sdl.K_s:
+		editor.save(data)
+	default:
+		return false
+	}
+	return true
+}
+
+func (editor *ToneEditor) startTyping(renaming bool, input string) {
+	editor.typing = true
+	editor.renaming = renaming
+	editor.input = input
+	sdl.StartTextInput()
+}
+
+func (editor *ToneEditor) typeText(text string) {
+	// tone names are separated by white space in the tone file
+	editor.input += strings.Join(strings.Fields(text), "")
+}
+
+// typeKey handles keys while typing a tone name.
+func (editor *ToneEditor) typeKey(data *AggregatedData, key sdl.Keycode) {
+	switch key {
+	case sdl.K_BACKSPACE:
+		if runes := []rune(editor.input); len(runes) > 0 {
+			editor.input = string(runes[:len(runes)-1])
+		}
+		return
+	case sdl.K_RETURN:
+		if _, exists := data.tones[editor.input]; exists && (editor.input != editor.selected || !editor.renaming) {
+			fmt.Fprintf(os.Stderr, "Tone %s already exists\n", editor.input)
+			return
+		}
+		if editor.input != "" && editor.input != editor.selected {
+			editor.remember(data)
+			tone := make([]Peak, 0)
+			if editor.renaming {
+				tone = data.tones[editor.selected]
+				delete(data.tones, editor.selected)
+			}
+			data.tones[editor.input] = tone
+			editor.selected = editor.input
+		}
+	case sdl.K_ESCAPE:
+	default:
+		return
+	}
+	editor.typing = false
+	sdl.StopTextInput()
+}
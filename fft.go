@@ -0,0 +1,8 @@
+package main
+
+// FFT computes an unnormalized forward discrete Fourier transform in place.
+// The implementation is selected at build time: go-fftw by default, or the
+// pure Go one when built with the purego tag.
+type FFT interface {
+	transform(values []complex128)
+}
@@ -0,0 +1,24 @@
+//go:build !purego
+// +build !purego
+
+package main
+
+import (
+	"github.com/jvlmdr/go-fftw/fftw"
+)
+
+const fftBackend = "fftw"
+
+type fftwFFT struct {
+	buffer *fftw.Array
+}
+
+func newFFT(size int) FFT {
+	return &fftwFFT{fftw.NewArray(size)}
+}
+
+func (fft *fftwFFT) transform(values []complex128) {
+	copy(fft.buffer.Elems, values)
+	fftw.FFTTo(fft.buffer, fft.buffer)
+	copy(values, fft.buffer.Elems)
+}
@@ -0,0 +1,118 @@
+//go:build purego
+// +build purego
+
+package main
+
+import (
+	"math"
+	"math/bits"
+	"math/cmplx"
+)
+
+const fftBackend = "purego"
+
+type pureFFT struct {
+	size int
+	// exp(-2*pi*i*k/size) for k in [0, size)
+	twiddle []complex128
+	// prime factors of size, used by the mixed-radix path
+	factors []int
+	scratch []complex128
+	butterfly []complex128
+}
+
+func newFFT(size int) FFT {
+	fft := &pureFFT{size: size}
+	fft.twiddle = make([]complex128, size)
+	for k := range fft.twiddle {
+		fft.twiddle[k] = cmplx.Exp(complex(0, -2*math.Pi*(float64)(k)/(float64)(size)))
+	}
+	if !isPowerOfTwo(size) {
+		fft.factors = primeFactors(size)
+		fft.scratch = make([]complex128, size)
+		fft.butterfly = make([]complex128, fft.factors[len(fft.factors)-1])
+	}
+	return fft
+}
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+func primeFactors(n int) []int {
+	factors := make([]int, 0)
+	for p := 2; p*p <= n; p++ {
+		for n%p == 0 {
+			factors = append(factors, p)
+			n /= p
+		}
+	}
+	if n > 1 {
+		factors = append(factors, n)
+	}
+	return factors
+}
+
+func (fft *pureFFT) transform(values []complex128) {
+	if fft.size <= 1 {
+		return
+	}
+	if fft.factors == nil {
+		fft.radix2(values)
+		return
+	}
+	copy(fft.scratch, values)
+	fft.mixedRadix(values, fft.scratch, 1, fft.factors)
+}
+
+// radix2 is an iterative in-place decimation in time transform.
+func (fft *pureFFT) radix2(values []complex128) {
+	n := fft.size
+	shift := (uint)(bits.UintSize - bits.TrailingZeros((uint)(n)))
+	for i := 0; i < n; i++ {
+		j := (int)(bits.Reverse((uint)(i)) >> shift)
+		if i < j {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+	for half := 1; half < n; half *= 2 {
+		step := n / (2 * half)
+		for start := 0; start < n; start += 2 * half {
+			for k := 0; k < half; k++ {
+				even := values[start+k]
+				odd := values[start+k+half] * fft.twiddle[k*step]
+				values[start+k] = even + odd
+				values[start+k+half] = even - odd
+			}
+		}
+	}
+}
+
+// mixedRadix is a recursive decimation in time transform of src (read with
+// the given stride) into dst, splitting by the first of factors.
+func (fft *pureFFT) mixedRadix(dst, src []complex128, stride int, factors []int) {
+	n := len(dst)
+	if n == 1 {
+		dst[0] = src[0]
+		return
+	}
+	p := factors[0]
+	m := n / p
+	for q := 0; q < p; q++ {
+		fft.mixedRadix(dst[q*m:(q+1)*m], src[q*stride:], stride*p, factors[1:])
+	}
+	// combine p sub-transforms of length m with a generic radix-p butterfly
+	tmp := fft.butterfly[:p]
+	for k := 0; k < m; k++ {
+		for q := 0; q < p; q++ {
+			tmp[q] = dst[q*m+k] * fft.twiddle[(q*k*stride)%fft.size]
+		}
+		for s := 0; s < p; s++ {
+			var sum complex128
+			for q := 0; q < p; q++ {
+				sum += tmp[q] * fft.twiddle[(q*s*m*stride)%fft.size]
+			}
+			dst[s*m+k] = sum
+		}
+	}
+}
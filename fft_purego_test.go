@@ -0,0 +1,60 @@
+//go:build purego
+// +build purego
+
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+// dft is the naive transform the FFT is compared to.
+func dft(values []complex128) []complex128 {
+	n := len(values)
+	result := make([]complex128, n)
+	for k := range result {
+		for j, value := range values {
+			result[k] += value * cmplx.Exp(complex(0, -2*math.Pi*(float64)(j*k%n)/(float64)(n)))
+		}
+	}
+	return result
+}
+
+func TestPureFFT(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	// powers of two take the radix-2 path, the others the mixed-radix one
+	for _, size := range []int{1, 2, 4, 256, 1024, 2048, 3, 6, 12, 15, 49, 97, 210, 1000} {
+		values := make([]complex128, size)
+		for i := range values {
+			values[i] = complex(random.Float64()*2-1, random.Float64()*2-1)
+		}
+		expected := dft(values)
+		newFFT(size).transform(values)
+		// the error of both transforms grows with the size
+		tolerance := 1e-9 * (float64)(size)
+		for k := range values {
+			if difference := cmplx.Abs(values[k] - expected[k]); difference > tolerance {
+				t.Errorf("size %d, bin %d: got %v, expected %v", size, k, values[k], expected[k])
+				break
+			}
+		}
+	}
+}
+
+func TestPureFFTReuse(t *testing.T) {
+	// the scratch buffers must not leak data between transforms
+	fft := newFFT(12)
+	for i := 0; i < 2; i++ {
+		values := make([]complex128, 12)
+		values[i] = 1
+		expected := dft(values)
+		fft.transform(values)
+		for k := range values {
+			if cmplx.Abs(values[k]-expected[k]) > 1e-12 {
+				t.Fatalf("transform %d, bin %d: got %v, expected %v", i, k, values[k], expected[k])
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Interpolation selects how the fractional position of a peak is estimated
+// from the peak bin and its two neighbours.
+type Interpolation int
+
+const (
+	interpolationNone Interpolation = iota
+	interpolationParabolic
+	interpolationGaussian
+)
+
+var interpolationNames = []string{"none", "parabolic", "gaussian"}
+
+func (interpolation Interpolation) String() string {
+	return interpolationNames[interpolation]
+}
+
+func (interpolation *Interpolation) Set(value string) error {
+	for i, name := range interpolationNames {
+		if name == value {
+			*interpolation = (Interpolation)(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown interpolation %q, expected one of: %s", value, strings.Join(interpolationNames, ", "))
+}
+
+// vertex returns offset of the vertex of parabola going through (-1, a),
+// (0, b) and (1, c) together with its value.
+func vertex(a, b, c float64) (float64, float64) {
+	denominator := a - 2*b + c
+	if denominator == 0 {
+		return 0, b
+	}
+	offset := 0.5 * (a - c) / denominator
+	return offset, b - 0.25*(a-c)*offset
+}
+
+// interpolate returns fractional bin and value of the peak at index.
+func (interpolation Interpolation) interpolate(values []float64, index int) (float64, float64) {
+	if index <= 0 || index >= len(values)-1 {
+		return (float64)(index), values[index]
+	}
+	a, b, c := values[index-1], values[index], values[index+1]
+	switch interpolation {
+	case interpolationParabolic:
+		offset, value := vertex(a, b, c)
+		return (float64)(index) + offset, value
+	case interpolationGaussian:
+		if a <= 0 || b <= 0 || c <= 0 {
+			// logarithm is not defined, fall back to parabola
+			offset, value := vertex(a, b, c)
+			return (float64)(index) + offset, value
+		}
+		offset, value := vertex(math.Log(a), math.Log(b), math.Log(c))
+		return (float64)(index) + offset, math.Exp(value)
+	}
+	return (float64)(index), b
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+type MouseState struct {
+	x int32
+	y int32
+	// dragging pans the view
+	panning bool
+	// dragging selects range to zoom into
+	selecting bool
+	selectFrom int32
+}
+
+// wheelZoom is the zoom applied by one step of the mouse wheel
+const wheelZoom = 1.25
+
+// selections narrower than minSelection pixels are ignored
+const minSelection = 3
+
+// relativeX returns position of x in the spectrum area.
+func (gui *Gui) relativeX(x int32) float64 {
+	return (float64)(x-gui.area.X) / (float64)(gui.area.W)
+}
+
+// inView reports whether x, y is inside the spectrum or the waterfall.
+func (gui *Gui) inView(x int32, y int32) bool {
+	point := sdl.Point{x, y}
+	return point.InRect(&gui.area) || point.InRect(&gui.waterfallArea)
+}
+
+func (gui *Gui) handleMouse(event sdl.Event, data *AggregatedData) {
+	mouse := &gui.mouse
+	switch t := event.(type) {
+	case *sdl.MouseMotionEvent:
+		mouse.x, mouse.y = t.X, t.Y
+		if mouse.panning {
+			gui.settings.pan(-(float64)(t.XRel) / (float64)(gui.area.W))
+		}
+	case *sdl.MouseWheelEvent:
+		steps := (float64)(t.Y)
+		if t.Direction == sdl.MOUSEWHEEL_FLIPPED {
+			steps = -steps
+		}
+		if gui.inView(mouse.x, mouse.y) {
+			gui.settings.zoomAround(gui.relativeX(mouse.x), math.Pow(wheelZoom, steps))
+		}
+	case *sdl.MouseButtonEvent:
+		mouse.x, mouse.y = t.X, t.Y
+		shift := sdl.GetModState()&sdl.KMOD_SHIFT != 0
+		switch {
+		case t.State == sdl.PRESSED && t.Button == sdl.BUTTON_LEFT && gui.legendAt(t.X, t.Y) != "":
+			gui.toggleTone(gui.legendAt(t.X, t.Y))
+		case t.State == sdl.PRESSED && t.Button == sdl.BUTTON_LEFT && !shift && gui.editPeak(data, t.X, t.Y):
+			// peak added to or removed from the edited tone
+		case t.State == sdl.PRESSED && !gui.inView(t.X, t.Y):
+			// ignore clicks outside of the spectrum and the waterfall
+		case t.State == sdl.PRESSED && (t.Button == sdl.BUTTON_RIGHT || t.Button == sdl.BUTTON_LEFT && shift):
+			mouse.selecting = true
+			mouse.selectFrom = t.X
+		case t.State == sdl.PRESSED && t.Button == sdl.BUTTON_LEFT:
+			mouse.panning = true
+		case t.State == sdl.RELEASED && mouse.selecting:
+			mouse.selecting = false
+			if math.Abs((float64)(t.X-mouse.selectFrom)) >= minSelection {
+				gui.settings.setRange(
+					gui.settings.binAt(gui.relativeX(mouse.selectFrom)),
+					gui.settings.binAt(gui.relativeX(t.X)),
+				)
+			}
+		case t.State == sdl.RELEASED:
+			mouse.panning = false
+		}
+	}
+}
+
+func (gui *Gui) drawOutline(rect sdl.Rect, color uint32) {
+	edges := []sdl.Rect{
+		{rect.X, rect.Y, rect.W, 1},
+		{rect.X, rect.Y + rect.H - 1, rect.W, 1},
+		{rect.X, rect.Y, 1, rect.H},
+		{rect.X + rect.W - 1, rect.Y, 1, rect.H},
+	}
+	for i := range edges {
+		gui.surface.FillRect(&edges[i], color)
+	}
+}
+
+func (gui *Gui) drawSelection() {
+	if !gui.mouse.selecting {
+		return
+	}
+	selectionColor := sdl.Color{255, 255, 255, 255}.Uint32()
+	from := (int32)(math.Min((float64)(gui.mouse.selectFrom), (float64)(gui.mouse.x)))
+	to := (int32)(math.Max((float64)(gui.mouse.selectFrom), (float64)(gui.mouse.x)))
+	gui.drawOutline(sdl.Rect{from, 0, to - from + 1, gui.height}, selectionColor)
+}
+
+// tooltipOffset is the distance of the tooltip from the mouse cursor
+const tooltipOffset = 15
+
+func (gui *Gui) drawTooltip(data *AggregatedData) {
+	mouse := &gui.mouse
+	if mouse.panning || !gui.inView(mouse.x, mouse.y) {
+		return
+	}
+	bin := gui.settings.binAt(gui.relativeX(mouse.x))
+	index := (int)(math.Max(0, math.Min(math.Round(bin), (float64)(len(data.values)-1))))
+	frequency := bin * gui.settings.binFrequency
+	gui.printPanel(mouse.x+tooltipOffset, mouse.y+tooltipOffset, []string{
+		fmt.Sprintf("Bin %d (%.2f)", index, bin),
+		fmt.Sprintf("%.1f Hz", frequency),
+		fmt.Sprintf("%v", noteOf(frequency, gui.settings.reference)),
+		fmt.Sprintf("Magnitude %.3f", data.values[index]),
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// NoiseProfile is the mean value of every bin captured while only the
+// background noise is present. It is subtracted from the aggregated values
+// before peaks are searched.
+type NoiseProfile struct {
+	values []float64
+	factor float64
+	filename string
+	// calibration in progress
+	calibrating bool
+	calibrateUntil uint32
+	sum []float64
+	frames int
+}
+
+func (noise *NoiseProfile) init(options Options) {
+	noise.factor = options.noiseFactor
+	noise.filename = options.noiseFile
+	noise.sum = make([]float64, options.samples/2)
+}
+
+func (noise *NoiseProfile) loaded() bool {
+	return noise.values != nil
+}
+
+func (noise *NoiseProfile) String() string {
+	if noise.calibrating {
+		left := (int64)(noise.calibrateUntil) - (int64)(ticks())
+		return fmt.Sprintf("calibrating (%.1f s left)", math.Max(0, (float64)(left)/1000))
+	}
+	if !noise.loaded() {
+		return "none"
+	}
+	return fmt.Sprintf("%s x%.1f", noise.filename, noise.factor)
+}
+
+func (noise *NoiseProfile) load(filename string, bins int) error {
+	file, error := os.Open(filename)
+	if error != nil {
+		return error
+	}
+	defer file.Close()
+	values := make([]float64, bins)
+	for {
+		var bin int
+		var value float64
+		_, err := fmt.Fscanln(file, &bin, &value)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if bin < 0 || bin >= bins {
+			return errors.New("Noise profile does not match the number of samples.")
+		}
+		values[bin] = value
+	}
+	noise.values = values
+	return nil
+}
+
+func (noise *NoiseProfile) save(filename string) error {
+	file, error := os.Create(filename)
+	if error != nil {
+		return error
+	}
+	writer := bufio.NewWriter(file)
+	for bin, value := range noise.values {
+		fmt.Fprintf(writer, "%d %g\n", bin, value)
+	}
+	if error = writer.Flush(); error != nil {
+		file.Close()
+		return error
+	}
+	return file.Close()
+}
+
+func (noise *NoiseProfile) calibrate(seconds float64) {
+	for i := range noise.sum {
+		noise.sum[i] = 0
+	}
+	noise.frames = 0
+	noise.calibrating = true
+	noise.calibrateUntil = ticks() + (uint32)(seconds*1000)
+}
+
+// update accumulates values while calibrating, it returns true when the
+// calibration has just finished.
+func (noise *NoiseProfile) update(values []float64) bool {
+	if !noise.calibrating {
+		return false
+	}
+	for i, value := range values {
+		noise.sum[i] += value
+	}
+	noise.frames++
+	if ticks() < noise.calibrateUntil {
+		return false
+	}
+	noise.calibrating = false
+	noise.values = make([]float64, len(noise.sum))
+	for i, sum := range noise.sum {
+		noise.values[i] = sum / (float64)(noise.frames)
+	}
+	return true
+}
+
+func (noise *NoiseProfile) subtract(values []float64) {
+	if !noise.loaded() {
+		return
+	}
+	for i := range values {
+		values[i] = math.Max(0, values[i]-noise.values[i]*noise.factor)
+	}
+}
+
+func (data *AggregatedData) updateNoise() {
+	if data.noise.update(data.values) {
+		if error := data.noise.save(data.noise.filename); error != nil {
+			print_error(error)
+		} else {
+			fmt.Fprintf(os.Stderr, "Noise profile saved to %s\n", data.noise.filename)
+		}
+	}
+	data.noise.subtract(data.values)
+}
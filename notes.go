@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+var noteNames = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// Note is the nearest equal-tempered note to a frequency.
+type Note struct {
+	// MIDI note number, A4 is 69
+	number int
+	// deviation of the frequency from the note
+	cents float64
+}
+
+func noteOf(frequency float64, reference float64) Note {
+	if frequency <= 0 || reference <= 0 {
+		return Note{-1, 0}
+	}
+	exact := 69 + 12*math.Log2(frequency/reference)
+	number := (int)(math.Round(exact))
+	return Note{number, (exact - (float64)(number)) * 100}
+}
+
+func (note Note) valid() bool {
+	return note.number >= 0
+}
+
+func (note Note) name() string {
+	if !note.valid() {
+		return "-"
+	}
+	return fmt.Sprintf("%s%d", noteNames[note.number%12], note.number/12-1)
+}
+
+func (note Note) String() string {
+	if !note.valid() {
+		return "-"
+	}
+	return fmt.Sprintf("%s %+.0fc", note.name(), note.cents)
+}
+
+func (note Note) frequency(reference float64) float64 {
+	return reference * math.Pow(2, ((float64)(note.number)-69)/12)
+}
+
+// harmonicTolerance is the relative distance of a peak from an integer
+// multiple of a candidate fundamental still considered to be its harmonic.
+const harmonicTolerance = 0.03
+
+// estimateFundamental picks the candidate explaining the most energy: its
+// own value plus values of all peaks at integer multiples of its frequency.
+func estimateFundamental(candidates []Peak, peaks []Peak) (Peak, bool) {
+	var best Peak
+	bestScore := math.Inf(-1)
+	for _, candidate := range candidates {
+		if candidate.frequency <= 0 {
+			continue
+		}
+		score := 0.0
+		for _, peak := range peaks {
+			ratio := peak.frequency / candidate.frequency
+			harmonic := math.Round(ratio)
+			if harmonic >= 1 && math.Abs(ratio-harmonic) <= harmonicTolerance*harmonic {
+				score += peak.value
+			}
+		}
+		if score > bestScore || (score == bestScore && candidate.frequency < best.frequency) {
+			best, bestScore = candidate, score
+		}
+	}
+	return best, !math.IsInf(bestScore, -1)
+}
+
+func (data *AggregatedData) fundamental() (Peak, bool) {
+	return estimateFundamental(data.sustainedPeaks(data.topPeaks), data.sustainedPeaks(data.peaks))
+}
+
+func (data *AggregatedData) detectNotes() []string {
+	detected := make([]string, 0, 1)
+	if fundamental, found := data.fundamental(); found {
+		detected = append(detected, noteOf(fundamental.frequency, data.reference).name())
+	}
+	return detected
+}
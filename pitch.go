@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Pitch is the fundamental frequency of a monophonic signal together with
+// the clarity of the estimate (1 for a perfectly periodic signal).
+type Pitch struct {
+	frequency float64
+	clarity float64
+}
+
+func (pitch Pitch) String() string {
+	return fmt.Sprintf("%.1f Hz (clarity %.2f)", pitch.frequency, pitch.clarity)
+}
+
+// PitchTracker estimates pitch in time domain using the YIN algorithm.
+type PitchTracker struct {
+	sampleRate float64
+	// absolute threshold of the normalized difference
+	threshold float64
+	minLag int
+	maxLag int
+	difference []float64
+}
+
+func (tracker *PitchTracker) init(options Options) {
+	tracker.sampleRate = (float64)(options.frequency)
+	tracker.threshold = options.pitchThreshold
+	tracker.minLag = (int)(math.Max(2, math.Floor(tracker.sampleRate/options.maxPitch)))
+	tracker.maxLag = (int)(math.Min((float64)(options.samples/2), math.Ceil(tracker.sampleRate/options.minPitch)))
+	tracker.difference = make([]float64, tracker.maxLag+1)
+}
+
+func (tracker *PitchTracker) track(samples []float64) Pitch {
+	window := len(samples) - tracker.maxLag
+	if window <= 0 || tracker.minLag >= tracker.maxLag {
+		return Pitch{}
+	}
+	// cumulative mean normalized difference
+	d := tracker.difference
+	d[0] = 1
+	sum := 0.0
+	for lag := 1; lag <= tracker.maxLag; lag++ {
+		value := 0.0
+		for j := 0; j < window; j++ {
+			delta := samples[j] - samples[j+lag]
+			value += delta * delta
+		}
+		sum += value
+		if sum == 0 {
+			d[lag] = 1
+		} else {
+			d[lag] = value * (float64)(lag) / sum
+		}
+	}
+	// first dip below threshold, global minimum otherwise
+	best := -1
+	for lag := tracker.minLag; lag <= tracker.maxLag; lag++ {
+		if d[lag] < tracker.threshold {
+			for lag+1 <= tracker.maxLag && d[lag+1] < d[lag] {
+				lag++
+			}
+			best = lag
+			break
+		}
+	}
+	if best < 0 {
+		best = tracker.minLag
+		for lag := tracker.minLag; lag <= tracker.maxLag; lag++ {
+			if d[lag] < d[best] {
+				best = lag
+			}
+		}
+	}
+	lag := (float64)(best)
+	value := d[best]
+	if best > 0 && best < tracker.maxLag {
+		offset, interpolated := vertex(d[best-1], d[best], d[best+1])
+		lag += offset
+		value = interpolated
+	}
+	return Pitch{tracker.sampleRate / lag, math.Max(0, math.Min(1, 1-value))}
+}
+
+func (data *AggregatedData) detectPitch() []string {
+	detected := make([]string, 0, 1)
+	if data.pitch.clarity >= data.minClarity {
+		detected = append(detected, noteOf(data.pitch.frequency, data.reference).name())
+	}
+	return detected
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ToneMatch is a tone explaining part of the detected peaks.
+type ToneMatch struct {
+	name string
+	// detected peaks used by the tone
+	peaks []Peak
+	// estimated amplitude of the tone relative to its configuration
+	gain float64
+	// part of the peak values explained by the tone
+	energy float64
+}
+
+func (match ToneMatch) String() string {
+	return fmt.Sprintf("%s (gain %.2f, energy %.2f): %v", match.name, match.gain, match.energy, match.peaks)
+}
+
+type toneCandidate struct {
+	name string
+	// template peaks and indexes of detected peaks matching them
+	template []Peak
+	matched []int
+}
+
+func templateValue(peak Peak) float64 {
+	if peak.value <= 0 || math.IsInf(peak.value, 0) || math.IsNaN(peak.value) {
+		return 1
+	}
+	return peak.value
+}
+
+// resolve greedily explains the detected peaks by tones. Every step picks
+// the tone explaining most of the remaining peak values, its contribution
+// is estimated by the most limiting of its peaks and subtracted. Tones
+// whose peaks are already explained by other tones (like a subset of a
+// detected tone) therefore explain nothing and are not reported.
+func (tones Tones) resolve(data *AggregatedData) []ToneMatch {
+	candidates := make([]toneCandidate, 0, len(tones))
+	for toneName, tone := range tones {
+		candidate := toneCandidate{toneName, tone, make([]int, 0, len(tone))}
+		for _, needPeak := range tone {
+			found := data.findPeak(needPeak)
+			if found < 0 {
+				break
+			}
+			candidate.matched = append(candidate.matched, found)
+		}
+		if len(tone) > 0 && len(candidate.matched) == len(tone) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	// deterministic order for equal scores
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].name < candidates[j].name
+	})
+	residual := make([]float64, len(data.peaks))
+	total := 0.0
+	for i, peak := range data.peaks {
+		residual[i] = peak.value
+		total += peak.value
+	}
+	matches := make([]ToneMatch, 0)
+	used := make([]bool, len(candidates))
+	for {
+		best := -1
+		var bestGain, bestEnergy float64
+		for c, candidate := range candidates {
+			if used[c] {
+				continue
+			}
+			gain := math.Inf(1)
+			for t, found := range candidate.matched {
+				gain = math.Min(gain, residual[found]/templateValue(candidate.template[t]))
+			}
+			energy := 0.0
+			for t := range candidate.matched {
+				energy += gain * templateValue(candidate.template[t])
+			}
+			if best < 0 || energy > bestEnergy ||
+				(energy == bestEnergy && len(candidate.matched) > len(candidates[best].matched)) {
+				best, bestGain, bestEnergy = c, gain, energy
+			}
+		}
+		if best < 0 || total <= 0 || bestEnergy < data.polyMinEnergy*total {
+			break
+		}
+		used[best] = true
+		candidate := candidates[best]
+		match := ToneMatch{candidate.name, make([]Peak, 0, len(candidate.matched)), bestGain, bestEnergy / total}
+		for t, found := range candidate.matched {
+			residual[found] = math.Max(0, residual[found]-bestGain*templateValue(candidate.template[t]))
+			match.peaks = append(match.peaks, data.peaks[found])
+		}
+		matches = append(matches, match)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].name < matches[j].name
+	})
+	return matches
+}
+
+func (data *AggregatedData) detectPoly() []string {
+	matches := data.tones.resolve(data)
+	detected := make([]string, 0, len(matches))
+	for _, match := range matches {
+		detected = append(detected, match.name)
+	}
+	return detected
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// number of frames waiting for the writer before new ones are dropped
+const recorderQueue = 256
+
+type recorderCommand struct {
+	// start recording to filename, stop when empty
+	start bool
+	dump bool
+	filename string
+	// closed when the command is done
+	done chan struct{}
+}
+
+// Recorder writes the samples received by recordCallback to WAV files. The
+// callback only queues copies of the samples, the files are written by
+// a separate goroutine.
+type Recorder struct {
+	rate int
+	frames chan []float32
+	commands chan recorderCommand
+	// queue frames at all, accessed by the callback
+	active int32
+	dropped int64
+	// rolling buffer of the last frames
+	buffer [][]float32
+	bufferNext int
+	bufferCount int
+	mux sync.Mutex
+	wav *WavWriter
+	filename string
+}
+
+var recorder *Recorder
+
+func (recorder *Recorder) init(options Options) {
+	recorder.rate = options.frequency
+	recorder.frames = make(chan []float32, recorderQueue)
+	recorder.commands = make(chan recorderCommand)
+	if options.recordBuffer > 0 {
+		frames := (int)(options.recordBuffer*(float64)(options.frequency))/options.samples + 1
+		recorder.buffer = make([][]float32, frames)
+		atomic.StoreInt32(&recorder.active, 1)
+	}
+	go recorder.run()
+	if options.record != "" {
+		recorder.start(options.record)
+	}
+}
+
+// add queues copy of the samples, it is called from the audio callback so
+// it never waits for the writer.
+func (recorder *Recorder) add(samples []float32) {
+	if atomic.LoadInt32(&recorder.active) == 0 {
+		return
+	}
+	frame := make([]float32, len(samples))
+	copy(frame, samples)
+	select {
+	case recorder.frames <- frame:
+	default:
+		atomic.AddInt64(&recorder.dropped, 1)
+	}
+}
+
+func (recorder *Recorder) start(filename string) {
+	recorder.commands <- recorderCommand{start: true, filename: filename}
+}
+
+// stop finishes the recording and waits until the file is closed.
+func (recorder *Recorder) stop() {
+	done := make(chan struct{})
+	recorder.commands <- recorderCommand{done: done}
+	<-done
+}
+
+// toggle stops the recording or starts a new one named by the current time.
+func (recorder *Recorder) toggle() {
+	if recorder.recording() {
+		recorder.stop()
+	} else {
+		recorder.start(timestampedName("wav"))
+	}
+}
+
+// dump saves the rolling buffer to a file named by the current time.
+func (recorder *Recorder) dump() {
+	if recorder.buffer == nil {
+		fmt.Fprintf(os.Stderr, "No record buffer, use -record-buffer SECONDS\n")
+		return
+	}
+	recorder.commands <- recorderCommand{dump: true, filename: timestampedName("wav")}
+}
+
+func timestampedName(extension string) string {
+	return fmt.Sprintf("analyzer-%s.%s", time.Now().Format("20060102-150405"), extension)
+}
+
+func (recorder *Recorder) recording() bool {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	return recorder.wav != nil
+}
+
+func (recorder *Recorder) String() string {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	status := "off"
+	if recorder.wav != nil {
+		status = fmt.Sprintf("%s (%.1f s)", recorder.filename, recorder.wav.seconds(recorder.rate))
+	}
+	if recorder.buffer != nil {
+		status += fmt.Sprintf(", buffer %.1f s", (float64)(recorder.bufferCount*len(recorder.lastFrame()))/(float64)(recorder.rate))
+	}
+	if dropped := atomic.LoadInt64(&recorder.dropped); dropped > 0 {
+		status += fmt.Sprintf(", %d frames dropped", dropped)
+	}
+	return status
+}
+
+func (recorder *Recorder) lastFrame() []float32 {
+	if recorder.bufferCount == 0 {
+		return nil
+	}
+	return recorder.buffer[(recorder.bufferNext-1+len(recorder.buffer))%len(recorder.buffer)]
+}
+
+func (recorder *Recorder) run() {
+	for {
+		select {
+		case frame := <-recorder.frames:
+			recorder.write(frame)
+		case command := <-recorder.commands:
+			switch {
+			case command.dump:
+				recorder.saveBuffer(command.filename)
+			case command.start:
+				recorder.close()
+				recorder.open(command.filename)
+			default:
+				recorder.close()
+			}
+			if command.done != nil {
+				close(command.done)
+			}
+		}
+	}
+}
+
+func (recorder *Recorder) write(frame []float32) {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	recorder.writeLocked(frame)
+}
+
+func (recorder *Recorder) writeLocked(frame []float32) {
+	if recorder.buffer != nil {
+		recorder.buffer[recorder.bufferNext] = frame
+		recorder.bufferNext = (recorder.bufferNext + 1) % len(recorder.buffer)
+		if recorder.bufferCount < len(recorder.buffer) {
+			recorder.bufferCount++
+		}
+	}
+	if recorder.wav == nil {
+		return
+	}
+	if error := recorder.wav.write(frame); error != nil {
+		print_error(error)
+		recorder.wav.close()
+		recorder.wav = nil
+	}
+}
+
+func (recorder *Recorder) open(filename string) {
+	wav, error := createWav(filename, recorder.rate)
+	if error != nil {
+		print_error(error)
+		return
+	}
+	recorder.mux.Lock()
+	recorder.wav, recorder.filename = wav, filename
+	recorder.mux.Unlock()
+	atomic.StoreInt32(&recorder.active, 1)
+	fmt.Fprintf(os.Stderr, "Recording to %s\n", filename)
+}
+
+func (recorder *Recorder) close() {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	if recorder.wav == nil {
+		return
+	}
+	// frames still queued belong to the recording
+	for len(recorder.frames) > 0 {
+		recorder.writeLocked(<-recorder.frames)
+	}
+	if recorder.wav == nil {
+		return
+	}
+	if error := recorder.wav.close(); error != nil {
+		print_error(error)
+	} else {
+		fmt.Fprintf(os.Stderr, "Recording saved to %s\n", recorder.filename)
+	}
+	recorder.wav = nil
+	if recorder.buffer == nil {
+		atomic.StoreInt32(&recorder.active, 0)
+	}
+}
+
+func (recorder *Recorder) saveBuffer(filename string) {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	for len(recorder.frames) > 0 {
+		recorder.writeLocked(<-recorder.frames)
+	}
+	wav, error := createWav(filename, recorder.rate)
+	if error != nil {
+		print_error(error)
+		return
+	}
+	oldest := (recorder.bufferNext - recorder.bufferCount + len(recorder.buffer)) % len(recorder.buffer)
+	for i := 0; i < recorder.bufferCount && error == nil; i++ {
+		error = wav.write(recorder.buffer[(oldest+i)%len(recorder.buffer)])
+	}
+	if error == nil {
+		error = wav.close()
+	} else {
+		wav.close()
+	}
+	if error != nil {
+		print_error(error)
+	} else {
+		fmt.Fprintf(os.Stderr, "Last %.1f s saved to %s\n", wav.seconds(recorder.rate), filename)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"unsafe"
+	"github.com/veandco/go-sdl2/sdl"
+	"github.com/veandco/go-sdl2/ttf"
+)
+
+func savePNG(surface *sdl.Surface, filename string) error {
+	format := surface.Format
+	if format == nil || format.BytesPerPixel != 4 {
+		return errors.New("Only 32 bit surfaces can be saved.")
+	}
+	width, height := (int)(surface.W), (int)(surface.H)
+	picture := image.NewRGBA(image.Rect(0, 0, width, height))
+	surface.Lock()
+	pixels := surface.Pixels()
+	pitch := (int)(surface.Pitch)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixel := *(*uint32)(unsafe.Pointer(&pixels[y*pitch+x*4]))
+			r, g, b, _ := sdl.GetRGBA(pixel, format)
+			picture.SetRGBA(x, y, color.RGBA{r, g, b, 255})
+		}
+	}
+	surface.Unlock()
+	file, error := os.Create(filename)
+	if error != nil {
+		return error
+	}
+	if error = png.Encode(file, picture); error != nil {
+		file.Close()
+		return error
+	}
+	return file.Close()
+}
+
+// saveScreenshot saves the debug window to a PNG named by the current time.
+func (gui *Gui) saveScreenshot() {
+	filename := timestampedName("png")
+	if error := savePNG(gui.surface, filename); error != nil {
+		print_error(error)
+	} else {
+		fmt.Fprintf(os.Stderr, "Screenshot saved to %s\n", filename)
+	}
+}
+
+// renderFile analyzes the input file and renders the view at -render-at
+// seconds to -render without opening a window or an audio device.
+func renderFile(options Options, gui *Gui) error {
+	var error error
+	if player == nil {
+		return errors.New("Nothing to render, use -input FILE.wav.")
+	}
+	if !ttf.WasInit() {
+		if error = ttf.Init(); error != nil {
+			return error
+		}
+	}
+	if gui.font, error = ttf.OpenFont("Sans.ttf", 12); error != nil {
+		return error
+	}
+	// same pixel format as the window surface
+	gui.surface, error = sdl.CreateRGBSurface(
+		0, gui.width, gui.height, 32, 0x00ff0000, 0x0000ff00, 0x000000ff, 0xff000000,
+	)
+	if error != nil {
+		return error
+	}
+	defer gui.surface.Free()
+	// no tooltip
+	gui.mouse.x, gui.mouse.y = -1, -1
+	data := new(AggregatedData)
+	data.init(options)
+	detected := make([]string, 0)
+	frameSeconds := (float64)(options.samples) / (float64)(options.frequency)
+	for (options.renderAt < 0 || player.seconds()+frameSeconds <= options.renderAt) && player.next(recordData) {
+		data.update(recordData)
+		data.updateNoise()
+		data.updatePeaks()
+		detected = data.detect()
+		gui.waterfall.push(data, detected)
+	}
+	gui.draw(data, detected)
+	return savePNG(gui.surface, options.render)
+}
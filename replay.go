@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Player feeds the analyzer by frames of the input file instead of the
+// audio device. The frames have the size of the buffers delivered by the
+// device, so a recording gives the same spectra as the live capture.
+type Player struct {
+	filename string
+	wav *WavFile
+	samples int
+	offset int
+	// wall clock time of the start of the playback, zero when paused
+	started time.Time
+}
+
+var player *Player
+
+func newPlayer(options Options) (*Player, error) {
+	wav, error := readWav(options.input)
+	if error != nil {
+		return nil, error
+	}
+	if wav.rate != options.frequency {
+		return nil, fmt.Errorf("%s is sampled at %d Hz, use -frequency %d", options.input, wav.rate, wav.rate)
+	}
+	return &Player{filename: options.input, wav: wav, samples: options.samples}, nil
+}
+
+// next pushes the next frame, it returns false at the end of the file.
+func (player *Player) next(data *AudioData) bool {
+	end := player.offset + player.samples
+	if end > len(player.wav.samples) {
+		return false
+	}
+	data.push(player.wav.samples[player.offset:end])
+	player.offset = end
+	// time of the end of the frame like in the live capture
+	simulating = true
+	simulatedTicks = (uint32)((int64)(end) * 1000 / (int64)(player.wav.rate))
+	return true
+}
+
+func (player *Player) seconds() float64 {
+	return (float64)(player.offset) / (float64)(player.wav.rate)
+}
+
+// due returns true when the next frame would be already captured if the
+// file was played live, so frames come at the rate of the capture.
+func (player *Player) due() bool {
+	now := time.Now()
+	if player.started.IsZero() {
+		player.started = now.Add(-player.position(player.offset))
+	}
+	return now.Sub(player.started) >= player.position(player.offset+player.samples)
+}
+
+// position returns time of the sample from the start of the file.
+func (player *Player) position(sample int) time.Duration {
+	return (time.Duration)((int64)(sample) * (int64)(time.Second) / (int64)(player.wav.rate))
+}
+
+// pause stops the clock, the playback continues where it was paused.
+func (player *Player) pause() {
+	player.started = time.Time{}
+}
+
+func (player *Player) String() string {
+	return fmt.Sprintf("%s %.1f / %.1f s", player.filename, player.seconds(), (float64)(len(player.wav.samples))/(float64)(player.wav.rate))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordingReplay(t *testing.T) {
+	options := Options{frequency: 8000, samples: 64, historySize: 3}
+	options.input = filepath.Join(t.TempDir(), "recording.wav")
+	t.Cleanup(func() {
+		simulating = false
+	})
+	frames := make([][]float32, 5)
+	for i := range frames {
+		frames[i] = make([]float32, options.samples)
+		for j := range frames[i] {
+			frames[i][j] = (float32)(math.Sin((float64)(i*options.samples+j) * 0.3))
+		}
+	}
+	// the live capture analyzes the frames delivered by the device and
+	// records them
+	live := new(AudioData)
+	live.init(options)
+	recorder := new(Recorder)
+	recorder.init(options)
+	done := make(chan struct{})
+	recorder.commands <- recorderCommand{start: true, filename: options.input, done: done}
+	<-done
+	for _, frame := range frames {
+		live.push(frame)
+		recorder.add(frame)
+	}
+	recorder.stop()
+	player, error := newPlayer(options)
+	if error != nil {
+		t.Fatal(error)
+	}
+	replayed := new(AudioData)
+	replayed.init(options)
+	for i := range frames {
+		if !player.next(replayed) {
+			t.Fatalf("replay ended after %d frames", i)
+		}
+		// the time of the end of the frame
+		if expected := (uint32)((i + 1) * options.samples * 1000 / options.frequency); ticks() != expected {
+			t.Errorf("frame %d: ticks %d, expected %d", i, ticks(), expected)
+		}
+	}
+	if player.next(replayed) {
+		t.Error("replay did not end with the recording")
+	}
+	if replayed.counter != live.counter {
+		t.Fatalf("replayed %d frames, captured %d", replayed.counter, live.counter)
+	}
+	for i := range live.values {
+		for bin := range live.values[i] {
+			if live.values[i][bin] != replayed.values[i][bin] {
+				t.Fatalf("spectrum %d differs in bin %d: %v, live %v", i, bin, replayed.values[i][bin], live.values[i][bin])
+			}
+		}
+	}
+}
+
+func TestPlayerRate(t *testing.T) {
+	wav := &WavFile{8000, make([]float32, 800)}
+	player := &Player{filename: "test.wav", wav: wav, samples: 80}
+	// a frame lasts 10 ms
+	if player.due() {
+		t.Error("first frame is due before it would be captured")
+	}
+	player.started = player.started.Add(-25 * time.Millisecond)
+	data := new(AudioData)
+	data.init(Options{samples: 80, historySize: 1})
+	t.Cleanup(func() {
+		simulating = false
+	})
+	frames := 0
+	for player.due() && player.next(data) {
+		frames++
+	}
+	if frames != 2 {
+		t.Errorf("%d frames due after 25 ms, expected 2", frames)
+	}
+	// pausing keeps the position
+	player.pause()
+	if player.due() {
+		t.Error("frame is due right after the playback continues")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// minimal distance of grid lines in pixels
+const minScaleSpacing = 60
+
+var scaleColor = sdl.Color{255, 0, 0, 255}
+
+// niceStep returns the smallest of 1, 2 or 5 times power of ten which is
+// not smaller than step.
+func niceStep(step float64) float64 {
+	if step <= 0 {
+		return 1
+	}
+	power := math.Pow(10, math.Floor(math.Log10(step)))
+	for _, multiple := range []float64{1, 2, 5, 10} {
+		if multiple*power >= step {
+			return multiple * power
+		}
+	}
+	return 10 * power
+}
+
+// drawScaleLines draws vertical grid lines at given bins skipping lines too
+// close to the previously drawn one.
+func (gui *Gui) drawScaleLines(bins []float64, labels []string) {
+	var scaleRect sdl.Rect
+	scaleRect.Y = 0
+	scaleRect.W = 1
+	scaleRect.H = gui.height
+	last := (int32)(math.MinInt32)
+	for i, bin := range bins {
+		x := gui.xOf(bin)
+		if x < 0 || x > gui.width || (int64)(x)-(int64)(last) < minScaleSpacing {
+			continue
+		}
+		last = x
+		scaleRect.X = x
+		gui.surface.FillRect(&scaleRect, scaleColor.Uint32())
+		labelRect := scaleRect
+		labelRect.X += 2
+		gui.printAt(labelRect, "%s", labels[i])
+	}
+}
+
+func formatFrequency(frequency float64) string {
+	if frequency >= 1000 {
+		return fmt.Sprintf("%g kHz", frequency/1000)
+	}
+	return fmt.Sprintf("%g Hz", frequency)
+}
+
+func (gui *Gui) drawFrequencyScales() {
+	low, high := gui.settings.viewRange()
+	binFrequency := gui.settings.binFrequency
+	lowFrequency, highFrequency := low*binFrequency, high*binFrequency
+	frequencies := make([]float64, 0)
+	if gui.settings.logFrequency {
+		// 1, 2 and 5 times powers of ten
+		for power := math.Floor(math.Log10(math.Max(lowFrequency, 1))); math.Pow(10, power) <= highFrequency; power++ {
+			for _, multiple := range []float64{1, 2, 5} {
+				frequency := multiple * math.Pow(10, power)
+				if frequency >= lowFrequency && frequency <= highFrequency {
+					frequencies = append(frequencies, frequency)
+				}
+			}
+		}
+	}
+	if len(frequencies) < 3 {
+		frequencies = frequencies[:0]
+		lines := math.Max(1, (float64)(gui.width/minScaleSpacing))
+		step := niceStep((highFrequency - lowFrequency) / lines)
+		for frequency := math.Ceil(lowFrequency/step) * step; frequency <= highFrequency; frequency += step {
+			frequencies = append(frequencies, frequency)
+		}
+	}
+	bins := make([]float64, len(frequencies))
+	labels := make([]string, len(frequencies))
+	for i, frequency := range frequencies {
+		bins[i] = frequency / binFrequency
+		labels[i] = formatFrequency(frequency)
+	}
+	gui.drawScaleLines(bins, labels)
+}
+
+func (gui *Gui) drawNoteScales() {
+	low, high := gui.settings.viewRange()
+	binFrequency := gui.settings.binFrequency
+	reference := gui.settings.reference
+	lowNote := noteOf(math.Max(low, 0.5)*binFrequency, reference)
+	highNote := noteOf(high*binFrequency, reference)
+	if !lowNote.valid() {
+		lowNote.number = 0
+	}
+	step := 1
+	if highNote.number-lowNote.number > (int)(gui.width/minScaleSpacing) {
+		// only C notes
+		step = 12
+	}
+	bins := make([]float64, 0)
+	labels := make([]string, 0)
+	for number := lowNote.number; number <= highNote.number; number++ {
+		if number%step != 0 {
+			continue
+		}
+		note := Note{number, 0}
+		bins = append(bins, note.frequency(reference)/binFrequency)
+		labels = append(labels, note.name())
+	}
+	gui.drawScaleLines(bins, labels)
+}
+
+func (gui *Gui) drawDecibelScales() {
+	var scaleRect sdl.Rect
+	step := 10.0
+	if (float64)(gui.height)/(-gui.settings.dbFloor/step) < minScaleSpacing/2 {
+		step = 20
+	}
+	scaleRect.X = 0
+	scaleRect.W = gui.width
+	scaleRect.H = 1
+	for db := 0.0; db > gui.settings.dbFloor; db -= step {
+		scaleRect.Y = gui.yOf(gui.settings.maxValue * math.Pow(10, db/20))
+		gui.surface.FillRect(&scaleRect, scaleColor.Uint32())
+		labelRect := scaleRect
+		labelRect.X = gui.width - minScaleSpacing
+		gui.printAt(labelRect, "%.0f dB", db)
+	}
+}
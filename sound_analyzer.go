@@ -1,3 +1,9 @@
+//go:build ignore
+// +build ignore
+
+// Early prototype of the analyzer, kept for reference.
+// Build it on its own: go build sound_analyzer.go
+
 package main
 
 /*
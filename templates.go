@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// size of the template peak markers in pixels
+const markerSize = 9
+
+type legendEntry struct {
+	name string
+	rect sdl.Rect
+}
+
+// toneColor returns distinct colour for the i-th tone, the alpha goes first
+// like in the other colours used to fill the window surface.
+func toneColor(i int) sdl.Color {
+	// golden ratio spreads the hues evenly
+	hue := math.Mod((float64)(i)*0.618033988749895, 1) * 6
+	x := 1 - math.Abs(math.Mod(hue, 2)-1)
+	var r, g, b float64
+	switch (int)(hue) {
+	case 0:
+		r, g, b = 1, x, 0
+	case 1:
+		r, g, b = x, 1, 0
+	case 2:
+		r, g, b = 0, 1, x
+	case 3:
+		r, g, b = 0, x, 1
+	case 4:
+		r, g, b = x, 0, 1
+	default:
+		r, g, b = 1, 0, x
+	}
+	return sdl.Color{255, (uint8)(r * 255), (uint8)(g * 255), (uint8)(b * 255)}
+}
+
+func (tones Tones) names() []string {
+	names := make([]string, 0, len(tones))
+	for name := range tones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (gui *Gui) toggleTone(name string) {
+	if gui.hiddenTones == nil {
+		gui.hiddenTones = make(map[string]bool)
+	}
+	gui.hiddenTones[name] = !gui.hiddenTones[name]
+}
+
+// drawTemplates marks configured peaks of every shown tone. Peaks matched
+// by a detected peak are filled, missing ones are hollow.
+func (gui *Gui) drawTemplates(data *AggregatedData) {
+	gui.surface.SetClipRect(&gui.area)
+	defer gui.surface.SetClipRect(nil)
+	for i, name := range data.tones.names() {
+		edited := gui.editor.enabled && name == gui.editor.selected
+		if gui.hiddenTones[name] && !edited {
+			continue
+		}
+		color := toneColor(i)
+		for _, peak := range data.tones[name] {
+			marker := sdl.Rect{
+				gui.xOf(peak.bin) - markerSize/2, gui.yOf(peak.value) - markerSize/2,
+				markerSize, markerSize,
+			}
+			if edited {
+				gui.drawOutline(sdl.Rect{marker.X - 2, marker.Y - 2, marker.W + 4, marker.H + 4}, sdl.Color{255, 255, 255, 255}.Uint32())
+			}
+			if found := data.findPeak(peak); found >= 0 {
+				gui.surface.FillRect(&marker, color.Uint32())
+				// connect the template with the matching peak
+				line := sdl.Rect{gui.xOf(data.peaks[found].bin), gui.yOf(data.peaks[found].value), 1, 0}
+				line.H = marker.Y - line.Y
+				if line.H < 0 {
+					line.Y, line.H = marker.Y+marker.H, -line.H-marker.H
+				}
+				gui.surface.FillRect(&line, color.Uint32())
+			} else {
+				gui.drawOutline(marker, color.Uint32())
+			}
+		}
+	}
+}
+
+// drawLegend lists tones in the top right corner, hidden tones are shown
+// hollow and detected ones are marked by a star. Clicking an entry
+// toggles the tone.
+func (gui *Gui) drawLegend(data *AggregatedData, detected []string) {
+	gui.legend = gui.legend[:0]
+	if !gui.showTemplates {
+		return
+	}
+	names := data.tones.names()
+	if len(names) == 0 {
+		return
+	}
+	isDetected := make(map[string]bool)
+	for _, name := range detected {
+		isDetected[name] = true
+	}
+	lineHeight := (int32)(gui.font.Height())
+	var width int32
+	labels := make([]string, len(names))
+	for i, name := range names {
+		labels[i] = name
+		if i < maxToneKeys {
+			labels[i] = fmt.Sprintf("%d %s", i+1, name)
+		}
+		if isDetected[name] {
+			labels[i] += " *"
+		}
+		labelWidth, _, _ := gui.font.SizeUTF8(labels[i])
+		width = (int32)(math.Max((float64)(width), (float64)(labelWidth)))
+	}
+	width += markerSize + 3*panelMargin
+	dst := sdl.Rect{gui.width - width - panelMargin, panelMargin, width, (int32)(len(names))*lineHeight + 2*panelMargin}
+	gui.surface.FillRect(&dst, sdl.Color{255, 10, 10, 10}.Uint32())
+	for i, name := range names {
+		entry := sdl.Rect{dst.X, dst.Y + panelMargin + (int32)(i)*lineHeight, dst.W, lineHeight}
+		marker := sdl.Rect{entry.X + panelMargin, entry.Y + (lineHeight-markerSize)/2, markerSize, markerSize}
+		color := toneColor(i).Uint32()
+		if gui.hiddenTones[name] {
+			gui.drawOutline(marker, color)
+		} else {
+			gui.surface.FillRect(&marker, color)
+		}
+		gui.printAt(sdl.Rect{marker.X + markerSize + panelMargin, entry.Y, 0, 0}, "%s", labels[i])
+		gui.legend = append(gui.legend, legendEntry{name, entry})
+	}
+}
+
+// tones listed first can be toggled by number keys 1-9
+const maxToneKeys = 9
+
+// toggleToneKey toggles tone assigned to a number key, it returns false
+// when there is no such tone.
+func (gui *Gui) toggleToneKey(data *AggregatedData, key sdl.Keycode) bool {
+	names := data.tones.names()
+	index := (int)(key - sdl.K_1)
+	if key < sdl.K_1 || index >= maxToneKeys || index >= len(names) {
+		return false
+	}
+	gui.toggleTone(names[index])
+	return true
+}
+
+// legendAt returns name of the tone listed at x, y or "" when there is none.
+func (gui *Gui) legendAt(x int32, y int32) string {
+	point := sdl.Point{x, y}
+	for _, entry := range gui.legend {
+		if point.InRect(&entry.rect) {
+			return entry.name
+		}
+	}
+	return ""
+}
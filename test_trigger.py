@@ -0,0 +1,233 @@
+#!/bin/python3
+
+import http.server
+import io
+import json
+import os
+import subprocess
+import sys
+import tempfile
+import threading
+import time
+import types
+import unittest
+
+import trigger
+
+def tone_names(sequence):
+    """Return names of the tones of a sequence made only of tones."""
+    node = trigger.parse_sequence(sequence)
+    items = node.items if isinstance(node, trigger.Concat) else [node]
+    return [set(item.names) for item in items]
+
+def events(*tones):
+    """Return events played 0.1 s apart, None is a rest."""
+    return [(0.1 * i, None if tone is None else frozenset(tone.split())) for i, tone in enumerate(tones)]
+
+NO_TIMING = types.SimpleNamespace(rhythm=None, tempo=None, max_gap=None, max_time=None)
+
+class SequenceTest(unittest.TestCase):
+    def test_note_words_are_split(self):
+        # sequences of the older versions, every character was a tone
+        self.assertEqual(tone_names('GBAD'), [{'G'}, {'B'}, {'A'}, {'D'}])
+        self.assertEqual(tone_names('GBA D'), [{'G'}, {'B'}, {'A'}, {'D'}])
+        self.assertEqual(tone_names('G B A D'), [{'G'}, {'B'}, {'A'}, {'D'}])
+        self.assertEqual(tone_names('C#4Bb3'), [{'C#4'}, {'A#3'}])
+
+    def test_single_letters(self):
+        self.assertEqual(tone_names('a'), [{'a'}])
+        self.assertEqual(tone_names('a b c'), [{'a'}, {'b'}, {'c'}])
+
+    def test_words_are_names(self):
+        # older versions split abc to a, b and c
+        self.assertEqual(tone_names('abc'), [{'abc'}])
+        self.assertEqual(tone_names('gong "AB" [a b]'), [{'gong'}, {'AB'}, {'a', 'b'}])
+
+    def test_old_sequence_matches(self):
+        sequence = trigger.parse_sequence('GBAD')
+        self.assertIsNotNone(trigger.find_match(sequence, events('G', 'B', 'A', 'D'), NO_TIMING))
+        # a single rest between tones was skipped too
+        self.assertIsNotNone(trigger.find_match(sequence, events('G', None, 'B', 'A', 'D'), NO_TIMING))
+        self.assertIsNone(trigger.find_match(sequence, events('G', None, None, 'B', 'A', 'D'), NO_TIMING))
+        self.assertIsNone(trigger.find_match(sequence, events('G', 'B', 'D', 'A'), NO_TIMING))
+
+    def test_errors(self):
+        for sequence in ['(G', 'G |', '[]', 'G{3,1}', 'G $']:
+            with self.assertRaises(trigger.SequenceError):
+                trigger.parse_sequence(sequence)
+
+class KeepReadingTest(unittest.TestCase):
+    """The input is drained until EOF after the last match."""
+    def run_trigger(self, *args):
+        lines = '[G]\n[B]\n[A]\n' + '[]\n[G]\n' * 100
+        return subprocess.run(
+            [sys.executable, trigger.__file__, '--keep-reading'] + list(args),
+            input=lines, capture_output=True, text=True, timeout=10,
+        )
+
+    def test_count(self):
+        result = self.run_trigger('-c', '1', 'GBA', 'echo', 'HIT')
+        self.assertEqual(result.returncode, 0)
+        self.assertEqual(result.stderr.count(': HIT'), 1)
+
+    def test_lock(self):
+        lock = trigger.make_lock(trigger.lock_melody(trigger.parse_sequence('G B A')))
+        result = self.run_trigger('--lock', lock, 'echo', 'OPEN')
+        self.assertEqual(result.returncode, 0)
+        self.assertEqual(result.stderr.count(': OPEN'), 1)
+        self.assertIn('Lock: opened', result.stderr)
+
+class CommandActionTest(unittest.TestCase):
+    def setUp(self):
+        self.log = io.StringIO()
+        trigger.log_file = self.log
+        self.match = trigger.describe_match('G B', [(time.monotonic(), frozenset(['G'])), (time.monotonic(), frozenset(['B']))], 2)
+
+    def perform(self, command, timeout=None):
+        args = types.SimpleNamespace(timeout=timeout, kill_grace=0.5)
+        trigger.CommandAction(['sh', '-c', command], args).perform(self.match)
+        return self.log.getvalue()
+
+    def test_output_and_exit_code(self):
+        log = self.perform('echo "$TRIGGER_SEQUENCE/$TRIGGER_NOTES/$TRIGGER_COUNT"; exit 3')
+        self.assertIn('Action #2: G B/G B/2', log)
+        self.assertIn('Action #2 exited with code 3', log)
+
+    def test_timeout_kills_group(self):
+        # the background process ignores SIGTERM and keeps the output open
+        with tempfile.TemporaryDirectory() as directory:
+            ticks = os.path.join(directory, 'ticks')
+            started = time.monotonic()
+            log = self.perform(
+                '(trap "" TERM; while true; do echo >> %s; sleep 0.05; done) & sleep 30' % ticks, timeout=0.2,
+            )
+            self.assertLess(time.monotonic() - started, 5)
+            self.assertIn('timed out after 0.2 s', log)
+            size = os.path.getsize(ticks)
+            time.sleep(0.3)
+            self.assertEqual(os.path.getsize(ticks), size, 'process of the group still runs')
+
+    def test_missing_command(self):
+        args = types.SimpleNamespace(timeout=None, kill_grace=0.5)
+        trigger.CommandAction(['/nonexistent/command'], args).perform(self.match)
+        self.assertIn('failed to start', self.log.getvalue())
+
+class BlockingAction:
+    def __init__(self):
+        self.release = threading.Event()
+        self.performed = []
+
+    def perform(self, match):
+        self.performed.append(match['count'])
+        self.release.wait(5)
+
+class ActionRunnerTest(unittest.TestCase):
+    def setUp(self):
+        self.log = io.StringIO()
+        trigger.log_file = self.log
+
+    def test_max_running(self):
+        action = BlockingAction()
+        runner = trigger.ActionRunner([action], types.SimpleNamespace(max_running=1))
+        runner.run('G', [(time.monotonic(), frozenset(['G']))], 1)
+        runner.run('G', [(time.monotonic(), frozenset(['G']))], 2)
+        action.release.set()
+        runner.wait()
+        runner.run('G', [(time.monotonic(), frozenset(['G']))], 3)
+        runner.wait()
+        self.assertEqual(action.performed, [1, 3])
+        self.assertIn('Skipped action #2', self.log.getvalue())
+
+    def test_unlimited(self):
+        action = BlockingAction()
+        runner = trigger.ActionRunner([action], types.SimpleNamespace(max_running=0))
+        for count in range(1, 4):
+            runner.run('G', [(time.monotonic(), frozenset(['G']))], count)
+        action.release.set()
+        runner.wait()
+        self.assertEqual(sorted(action.performed), [1, 2, 3])
+
+class Handler(http.server.BaseHTTPRequestHandler):
+    """Record requests and answer by the next code queued for the path."""
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers.get('Content-Length', 0)))
+        self.server.requests.append((self.command, self.path, self.headers, body))
+        codes = self.server.codes.get(self.path, [])
+        self.send_response(codes.pop(0) if codes else 200)
+        self.end_headers()
+
+    do_PUT = do_POST
+
+    def log_message(self, *args):
+        pass
+
+class HttpActionTest(unittest.TestCase):
+    def setUp(self):
+        self.server = http.server.ThreadingHTTPServer(('127.0.0.1', 0), Handler)
+        self.server.requests = []
+        self.server.codes = {}
+        thread = threading.Thread(target=self.server.serve_forever)
+        thread.start()
+        self.addCleanup(thread.join)
+        self.addCleanup(self.server.server_close)
+        self.addCleanup(self.server.shutdown)
+        self.log = io.StringIO()
+        trigger.log_file = self.log
+        self.match = trigger.describe_match(
+            'G B A', [(time.monotonic(), frozenset(['G'])), (time.monotonic(), frozenset(['A', 'B']))], 3,
+        )
+
+    def action(self, path, **options):
+        args = dict(
+            http_url='http://127.0.0.1:%d%s' % (self.server.server_port, path),
+            http_method='POST', http_header=[], http_body=None,
+            http_timeout=5, http_retries=3, http_backoff=0.01,
+        )
+        args.update(options)
+        return trigger.HttpAction(types.SimpleNamespace(**args))
+
+    def test_retry_server_errors(self):
+        self.server.codes['/flaky'] = [503, 500]
+        self.action('/flaky').perform(self.match)
+        self.assertEqual(len(self.server.requests), 3)
+        self.assertIn('returned 200', self.log.getvalue())
+
+    def test_give_up(self):
+        self.server.codes['/down'] = [503] * 3
+        self.action('/down', http_retries=2).perform(self.match)
+        self.assertEqual(len(self.server.requests), 3)
+        self.assertIn('giving up after 3 attempts', self.log.getvalue())
+
+    def test_no_retry_client_errors(self):
+        self.server.codes['/missing'] = [404, 200]
+        self.action('/missing').perform(self.match)
+        self.assertEqual(len(self.server.requests), 1)
+        self.assertIn('returned 404', self.log.getvalue())
+
+    def test_headers_and_body(self):
+        self.action('/hook', http_method='put', http_header=['X-Key: secret']).perform(self.match)
+        method, path, headers, body = self.server.requests[0]
+        self.assertEqual((method, path), ('PUT', '/hook'))
+        self.assertEqual(headers['X-Key'], 'secret')
+        self.assertEqual(headers['Content-Type'], 'application/json')
+        body = json.loads(body)
+        self.assertEqual(body['sequence'], 'G B A')
+        self.assertEqual(body['notes'], ['G', 'A+B'])
+        self.assertEqual(body['count'], 3)
+        self.assertEqual(len(body['times']), 2)
+
+    def test_body_template(self):
+        self.action('/hook', http_body='{"event": "door", "notes": $notes, "n": $count}').perform(self.match)
+        self.assertEqual(json.loads(self.server.requests[0][3]), {'event': 'door', 'notes': ['G', 'A+B'], 'n': 3})
+
+    def test_invalid_template(self):
+        for template in ['{"notes": $bogus}', '{"notes": "$notes"}', '{"a": 1']:
+            with self.assertRaises(ValueError):
+                self.action('/hook', http_body=template)
+
+    def test_invalid_header(self):
+        with self.assertRaises(ValueError):
+            self.action('/hook', http_header=['X-Key'])
+
+if __name__ == '__main__':
+    unittest.main()
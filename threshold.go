@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Threshold selects how the minimal peak value is computed for every bin.
+type Threshold int
+
+const (
+	// fixed -min-peak-value
+	thresholdAbsolute Threshold = iota
+	// multiple of the mean value
+	thresholdMean
+	// multiple of the median (noise floor)
+	thresholdMedian
+	// value at given percentile of all bins
+	thresholdPercentile
+	// multiple of the median computed separately for each band of bins
+	thresholdBand
+)
+
+var thresholdNames = []string{"absolute", "mean", "median", "percentile", "band"}
+
+func (threshold Threshold) String() string {
+	return thresholdNames[threshold]
+}
+
+func (threshold *Threshold) Set(value string) error {
+	for i, name := range thresholdNames {
+		if name == value {
+			*threshold = (Threshold)(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown threshold %q, expected one of: %s", value, strings.Join(thresholdNames, ", "))
+}
+
+func (threshold Threshold) next() Threshold {
+	return (threshold + 1) % (Threshold)(len(thresholdNames))
+}
+
+type ThresholdSettings struct {
+	strategy Threshold
+	minValue float64
+	factor float64
+	percentile float64
+	bands int
+}
+
+func (settings ThresholdSettings) String() string {
+	switch settings.strategy {
+	case thresholdAbsolute:
+		return fmt.Sprintf("%v %.2f", settings.strategy, settings.minValue)
+	case thresholdPercentile:
+		return fmt.Sprintf("%v %.1f%%", settings.strategy, settings.percentile)
+	case thresholdBand:
+		return fmt.Sprintf("%v x%.1f (%d bands)", settings.strategy, settings.factor, settings.bands)
+	}
+	return fmt.Sprintf("%v x%.1f", settings.strategy, settings.factor)
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64 = 0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / (float64)(len(values))
+}
+
+// median sorts values in place.
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[middle-1] + values[middle]) / 2
+	}
+	return values[middle]
+}
+
+// percentile sorts values in place.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	p = math.Max(0, math.Min(p, 100))
+	return values[(int)(math.Round(p/100*(float64)(len(values)-1)))]
+}
+
+// updateThreshold fills data.threshold, the DC part is not taken in account.
+// The computed threshold never drops below settings.minValue.
+func (data *AggregatedData) updateThreshold() {
+	settings := data.thresholdSettings
+	values := data.values[1:]
+	scratch := data.thresholdScratch[:len(values)]
+	level := settings.minValue
+	copy(scratch, values)
+	switch settings.strategy {
+	case thresholdMean:
+		level = mean(values) * settings.factor
+	case thresholdMedian:
+		level = median(scratch) * settings.factor
+	case thresholdPercentile:
+		level = percentile(scratch, settings.percentile)
+	case thresholdBand:
+		bands := (int)(math.Max(1, (float64)(settings.bands)))
+		bandSize := (len(values) + bands - 1) / bands
+		for from := 0; from < len(values); from += bandSize {
+			to := (int)(math.Min((float64)(from+bandSize), (float64)(len(values))))
+			level = math.Max(median(scratch[from:to])*settings.factor, settings.minValue)
+			for i := from; i < to; i++ {
+				data.threshold[i+1] = level
+			}
+		}
+		data.threshold[0] = data.threshold[1]
+		return
+	}
+	level = math.Max(level, settings.minValue)
+	for i := range data.threshold {
+		data.threshold[i] = level
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// PartialTrack links peaks of consecutive frames belonging to one partial.
+type PartialTrack struct {
+	id int
+	born uint32
+	// time of the last peak of the track
+	lastSeen uint32
+	dead bool
+	died uint32
+	// trajectory of the track, limited to the last maxTrackLength frames
+	frequencies []float64
+	amplitudes []float64
+}
+
+func (track *PartialTrack) String() string {
+	return fmt.Sprintf("#%d %.1f Hz (%d ms)", track.id, track.frequency(), track.age())
+}
+
+func (track *PartialTrack) age() uint32 {
+	return track.lastSeen - track.born
+}
+
+func (track *PartialTrack) frequency() float64 {
+	return track.frequencies[len(track.frequencies)-1]
+}
+
+func (track *PartialTrack) amplitude() float64 {
+	return track.amplitudes[len(track.amplitudes)-1]
+}
+
+func (track *PartialTrack) extend(peak Peak, ticks uint32) {
+	if len(track.frequencies) >= maxTrackLength {
+		track.frequencies = track.frequencies[1:]
+		track.amplitudes = track.amplitudes[1:]
+	}
+	track.frequencies = append(track.frequencies, peak.frequency)
+	track.amplitudes = append(track.amplitudes, peak.value)
+	track.lastSeen = ticks
+}
+
+const maxTrackLength = 256
+const maxFinishedTracks = 64
+
+type PartialTracker struct {
+	nextID int
+	active []*PartialTrack
+	// recently finished tracks, the oldest first
+	finished []*PartialTrack
+	byID map[int]*PartialTrack
+	// maximal frequency change (in Hz) between two frames
+	maxJump float64
+	// time (in ms) a track survives without any peak
+	maxGap uint32
+}
+
+func (tracker *PartialTracker) init(options Options) {
+	tracker.nextID = 1
+	tracker.active = make([]*PartialTrack, 0)
+	tracker.finished = make([]*PartialTrack, 0, maxFinishedTracks)
+	tracker.byID = make(map[int]*PartialTrack)
+	tracker.maxJump = options.trackTolerance * options.binFrequency()
+	tracker.maxGap = (uint32)(options.trackGap)
+}
+
+func (tracker *PartialTracker) track(id int) *PartialTrack {
+	return tracker.byID[id]
+}
+
+// update continues active tracks by the closest peaks, starts new tracks
+// for the remaining peaks and finishes tracks not seen for maxGap. Every
+// peak gets id of its track.
+func (tracker *PartialTracker) update(peaks []Peak, ticks uint32) {
+	type pair struct {
+		track int
+		peak int
+		distance float64
+	}
+	pairs := make([]pair, 0)
+	for t, track := range tracker.active {
+		for p, peak := range peaks {
+			distance := math.Abs(peak.frequency - track.frequency())
+			if distance <= tracker.maxJump {
+				pairs = append(pairs, pair{t, p, distance})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].distance < pairs[j].distance
+	})
+	trackUsed := make([]bool, len(tracker.active))
+	peakUsed := make([]bool, len(peaks))
+	for _, candidate := range pairs {
+		if trackUsed[candidate.track] || peakUsed[candidate.peak] {
+			continue
+		}
+		trackUsed[candidate.track] = true
+		peakUsed[candidate.peak] = true
+		track := tracker.active[candidate.track]
+		track.extend(peaks[candidate.peak], ticks)
+		peaks[candidate.peak].track = track.id
+	}
+	// finish tracks
+	active := tracker.active[:0]
+	for _, track := range tracker.active {
+		if ticks-track.lastSeen > tracker.maxGap {
+			tracker.finish(track)
+		} else {
+			active = append(active, track)
+		}
+	}
+	tracker.active = active
+	// start new tracks
+	for p, peak := range peaks {
+		if peakUsed[p] {
+			continue
+		}
+		track := &PartialTrack{id: tracker.nextID, born: ticks}
+		track.extend(peak, ticks)
+		tracker.nextID++
+		tracker.active = append(tracker.active, track)
+		tracker.byID[track.id] = track
+		peaks[p].track = track.id
+	}
+}
+
+func (tracker *PartialTracker) finish(track *PartialTrack) {
+	track.dead = true
+	track.died = track.lastSeen
+	if len(tracker.finished) >= maxFinishedTracks {
+		delete(tracker.byID, tracker.finished[0].id)
+		tracker.finished = tracker.finished[1:]
+	}
+	tracker.finished = append(tracker.finished, track)
+}
+
+// sustained reports whether the peak belongs to a track lasting at least
+// minSustain.
+func (data *AggregatedData) sustained(peak Peak) bool {
+	if data.minSustain == 0 {
+		return true
+	}
+	track := data.tracker.track(peak.track)
+	return track != nil && track.age() >= data.minSustain
+}
+
+func (data *AggregatedData) sustainedPeaks(peaks []Peak) []Peak {
+	if data.minSustain == 0 {
+		return peaks
+	}
+	sustained := make([]Peak, 0, len(peaks))
+	for _, peak := range peaks {
+		if data.sustained(peak) {
+			sustained = append(sustained, peak)
+		}
+	}
+	return sustained
+}
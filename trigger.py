@@ -1,19 +1,267 @@
 #!/bin/python3
 
 import argparse
-import functools
-import io
+import getpass
+import hashlib
+import hmac
+import json
+import os
+import signal
 import subprocess
 import sys
 import re
+import secrets
+import string
+import threading
+import time
+import urllib.error
+import urllib.request
 
-def make_pattern(sequence):
-    pattern = ''
-    for char in sequence:
-        if char == ' ':
-            char = ''
-        pattern += r'%s(?: )?' % char
-    return pattern
+NOTE_VALUES = {
+    'w': 4, 'whole': 4,
+    'h': 2, 'half': 2,
+    'q': 1, 'quarter': 1,
+    'e': 0.5, 'eighth': 0.5,
+    's': 0.25, 'sixteenth': 0.25,
+}
+
+class SequenceError(Exception):
+    def __init__(self, message, position):
+        super().__init__(message)
+        self.message = message
+        self.position = position
+
+    def describe(self, sequence):
+        return '%s\n  %s\n  %s^' % (self.message, sequence, ' ' * self.position)
+
+# note names like C, F#4 or Bb3, a word made only of them is split to notes
+NOTE = r'[A-G](?:#|b)?(?:-?\d+)?'
+NOTES = re.compile(r'(?:%s)+$' % NOTE)
+TOKEN = re.compile(r'''
+    (?P<space>\s+)
+  | "(?P<quoted>[^"]*)"
+  | (?P<word>[A-Za-z0-9][\w#]*)
+  | \{\s*(?P<min>\d+)\s*(?:(?P<comma>,)\s*(?P<max>\d*)\s*)?\}
+  | (?P<symbol>[()\[\]|.*+?_])
+''', re.VERBOSE)
+
+def tokenize(sequence):
+    """Split sequence to (kind, value, position) tokens."""
+    tokens = []
+    position = 0
+    while position < len(sequence):
+        mo = TOKEN.match(sequence, position)
+        if mo is None:
+            raise SequenceError('unexpected character %r' % sequence[position], position)
+        if mo.group('quoted') is not None:
+            if mo.group('quoted') == '':
+                raise SequenceError('empty tone name', position)
+            tokens.append(('name', mo.group('quoted'), position))
+        elif mo.group('word') is not None:
+            word = mo.group('word')
+            if NOTES.match(word):
+                for note in re.finditer(NOTE, word):
+                    tokens.append(('name', sharp_name(note.group()), position + note.start()))
+            else:
+                tokens.append(('name', word, position))
+        elif mo.group('min') is not None:
+            low = int(mo.group('min'))
+            if mo.group('comma') is None:
+                high = low
+            elif mo.group('max'):
+                high = int(mo.group('max'))
+            else:
+                high = None
+            if high is not None and high < low:
+                raise SequenceError('repetition maximum is lower than minimum', position)
+            tokens.append(('repeat', (low, high), position))
+        elif mo.group('symbol') is not None:
+            tokens.append((mo.group('symbol'), None, position))
+        position = mo.end()
+    tokens.append(('end', None, len(sequence)))
+    return tokens
+
+# Nodes of the parsed sequence, tones are sets of names detected together,
+# None matches any tone.
+class Tone:
+    def __init__(self, names):
+        self.names = names
+
+class Rest:
+    pass
+
+class Concat:
+    def __init__(self, items):
+        self.items = items
+
+class Alternative:
+    def __init__(self, options):
+        self.options = options
+
+class Repeat:
+    def __init__(self, item, low, high):
+        self.item = item
+        self.low = low
+        self.high = high
+
+class SequenceParser:
+    """Recursive descent parser of the sequence language:
+        alternative := concat ('|' concat)*
+        concat := repeat+
+        repeat := atom ('*' | '+' | '?' | '{n}' | '{n,}' | '{n,m}')*
+        atom := name | '.' | '_' | '(' alternative ')' | '[' name+ ']'
+    """
+    def __init__(self, sequence):
+        self.tokens = tokenize(sequence)
+        self.index = 0
+
+    def peek(self):
+        return self.tokens[self.index]
+
+    def take(self):
+        token = self.tokens[self.index]
+        self.index += 1
+        return token
+
+    def parse(self):
+        node = self.alternative()
+        kind, _, position = self.peek()
+        if kind != 'end':
+            raise SequenceError('unexpected %r' % kind, position)
+        return node
+
+    def alternative(self):
+        options = [self.concat()]
+        while self.peek()[0] == '|':
+            self.take()
+            options.append(self.concat())
+        return options[0] if len(options) == 1 else Alternative(options)
+
+    def concat(self):
+        items = []
+        while self.peek()[0] not in ('|', ')', 'end'):
+            items.append(self.repeat())
+        if not items:
+            raise SequenceError('expected a tone', self.peek()[2])
+        return items[0] if len(items) == 1 else Concat(items)
+
+    def repeat(self):
+        node = self.atom()
+        while self.peek()[0] in ('*', '+', '?', 'repeat'):
+            kind, value, _ = self.take()
+            low, high = {'*': (0, None), '+': (1, None), '?': (0, 1)}.get(kind, value)
+            node = Repeat(node, low, high)
+        return node
+
+    def atom(self):
+        kind, value, position = self.take()
+        if kind == 'name':
+            return Tone(frozenset([value]))
+        if kind == '.':
+            return Tone(None)
+        if kind == '_':
+            return Rest()
+        if kind == '(':
+            node = self.alternative()
+            if self.take()[0] != ')':
+                raise SequenceError('missing ")" for "(" here', position)
+            return node
+        if kind == '[':
+            names = []
+            while self.peek()[0] == 'name':
+                names.append(self.take()[1])
+            if self.take()[0] != ']':
+                raise SequenceError('only tone names can be in "[" here', position)
+            if not names:
+                raise SequenceError('empty group of simultaneous tones', position)
+            return Tone(frozenset(names))
+        if kind == 'end':
+            raise SequenceError('unexpected end of the sequence', position)
+        raise SequenceError('expected a tone instead of %r' % kind, position)
+
+def parse_sequence(sequence):
+    return SequenceParser(sequence).parse()
+
+def tone_count(node):
+    """Return minimal and maximal (None when unlimited) number of tones
+    matched by node."""
+    if isinstance(node, Tone):
+        return 1, 1
+    if isinstance(node, Rest):
+        return 0, 0
+    if isinstance(node, Concat):
+        counts = [tone_count(item) for item in node.items]
+        highs = [high for _, high in counts]
+        return sum(low for low, _ in counts), None if None in highs else sum(highs)
+    if isinstance(node, Alternative):
+        counts = [tone_count(option) for option in node.options]
+        highs = [high for _, high in counts]
+        return min(low for low, _ in counts), None if None in highs else max(highs)
+    low, high = tone_count(node.item)
+    if node.high is None or high is None:
+        return low * node.low, None if high != 0 else 0
+    return low * node.low, high * node.high
+
+def is_rest(event):
+    return event[1] is None
+
+def match(node, events, start, memo):
+    """Return the set of ends for which node matches events[start:end].
+    Events are (time, tones) with tones None for a rest. A single rest
+    before a tone is skipped, unless the sequence expects it.
+    Results are kept in memo by (node, start), so nested repetitions do not
+    try exponentially many ways to match the same events."""
+    key = (node, start)
+    if key not in memo:
+        memo[key] = frozenset(match_node(node, events, start, memo))
+    return memo[key]
+
+def match_node(node, events, start, memo):
+    if isinstance(node, Tone):
+        for index in (start, start + 1):
+            if index >= len(events):
+                break
+            onset, tones = events[index]
+            if tones is not None and (node.names is None or node.names <= tones):
+                yield index + 1
+            if index > start or not is_rest(events[index]):
+                break
+    elif isinstance(node, Rest):
+        end = start
+        while end < len(events) and is_rest(events[end]):
+            end += 1
+            yield end
+    elif isinstance(node, Concat):
+        ends = {start}
+        for item in node.items:
+            ends = set().union(*(match(item, events, middle, memo) for middle in ends))
+        yield from ends
+    elif isinstance(node, Alternative):
+        for option in node.options:
+            yield from match(option, events, start, memo)
+    else:
+        yield from match_repeat(node, events, start, memo)
+
+def match_repeat(node, events, start, memo):
+    # ends after the same number of repetitions, every repetition moves
+    # them forward as an empty repetition would repeat forever
+    ends = {start}
+    reached = set()
+    done = 0
+    while ends:
+        if done >= node.low:
+            ends -= reached
+            reached |= ends
+        if node.high is not None and done >= node.high:
+            break
+        ends = {
+            end
+            for middle in ends
+            for end in match(node.item, events, middle, memo)
+            if end > middle
+        }
+        done += 1
+    return reached
 
 def parse_line(valid_line, line, previous):
     mo = valid_line.match(line)
@@ -26,14 +274,484 @@ def parse_line(valid_line, line, previous):
     previous = set(chars)
     return previous, current
 
+def parse_rhythm(rhythm):
+    """Parse durations like "q q h" or "1 1 2" in quarter notes, a dot
+    after a note value makes it one and half times longer."""
+    durations = []
+    for token in re.split(r'[\s,-]+', rhythm.strip()):
+        dotted = token.endswith('.')
+        if dotted:
+            token = token[:-1]
+        if token in NOTE_VALUES:
+            duration = NOTE_VALUES[token]
+        else:
+            try:
+                duration = float(token)
+            except ValueError:
+                raise ValueError('invalid note value %r' % token)
+        if duration <= 0:
+            raise ValueError('note value %r is not positive' % token)
+        durations.append(duration * 1.5 if dotted else duration)
+    return durations
+
+def check_timing(onsets, args):
+    """Check times of the matched tones against the timing constraints."""
+    intervals = [b - a for a, b in zip(onsets, onsets[1:])]
+    if args.max_gap is not None and any(i > args.max_gap for i in intervals):
+        return False
+    if args.max_time is not None and onsets[-1] - onsets[0] > args.max_time:
+        return False
+    if args.rhythm is None or not intervals:
+        return True
+    if len(args.rhythm) not in (len(onsets) - 1, len(onsets)):
+        return False
+    # duration of the last tone is unknown, it is ended by no onset
+    expected = args.rhythm[:len(intervals)]
+    if sum(intervals) <= 0:
+        return False
+    # seconds per quarter note, estimated from the played tones so the
+    # rhythm matches at any tempo
+    beat = sum(intervals) / sum(expected)
+    if args.tempo is not None and abs(beat * args.tempo / 60 - 1) > args.tempo_tolerance:
+        return False
+    for played, duration in zip(intervals, expected):
+        if abs(played / (duration * beat) - 1) > args.rhythm_tolerance:
+            return False
+    return True
+
+def tone_elements(node):
+    """Return tones of a sequence without alternatives, repetitions and
+    rests, which is needed for the approximate matching."""
+    items = node.items if isinstance(node, Concat) else [node]
+    if not all(isinstance(item, Tone) for item in items):
+        raise SequenceError('approximate matching supports only tones, "." and "[...]"', 0)
+    return items
+
+def tone_name(element):
+    if element.names is None:
+        return '.'
+    if len(element.names) == 1:
+        return next(iter(element.names))
+    return '[%s]' % ' '.join(sorted(element.names))
+
+def approximate_match(elements, events, args):
+    """Align the elements with the tones ending by the last event with the
+    smallest edit distance. Return the distance and the alignment as
+    (operation, element, event) from the first tone."""
+    tones = [event for event in events if not is_rest(event)]
+    costs = {'sub': args.substitution_cost, 'ins': args.insertion_cost, 'del': args.deletion_cost}
+    # distance[i][j] aligns i elements with tones ending by j-th tone, the
+    # alignment may start at any tone
+    distance = [[0.0] * (len(tones) + 1)]
+    steps = [[None] * (len(tones) + 1)]
+    for i, element in enumerate(elements, 1):
+        distance.append([distance[i - 1][0] + costs['del']])
+        steps.append(['del'])
+        for j, (_, played) in enumerate(tones, 1):
+            same = element.names is None or element.names <= played
+            candidates = [
+                (distance[i - 1][j - 1] + (0 if same else costs['sub']), 'match' if same else 'sub'),
+                (distance[i - 1][j] + costs['del'], 'del'),
+                (distance[i][j - 1] + costs['ins'], 'ins'),
+            ]
+            best = min(candidates, key=lambda candidate: candidate[0])
+            distance[i].append(best[0])
+            steps[i].append(best[1])
+    i, j = len(elements), len(tones)
+    alignment = []
+    while i > 0:
+        step = steps[i][j]
+        if step == 'del':
+            alignment.append((step, elements[i - 1], None))
+            i -= 1
+        elif step == 'ins':
+            alignment.append((step, None, tones[j - 1]))
+            j -= 1
+        else:
+            alignment.append((step, elements[i - 1], tones[j - 1]))
+            i, j = i - 1, j - 1
+    alignment.reverse()
+    return distance[len(elements)][len(tones)], alignment
+
+def describe_alignment(distance, alignment):
+    """Format the alignment as rows of expected and played tones and the
+    operations: = match, ~ substitution, + insertion, - deletion."""
+    symbols = {'match': '=', 'sub': '~', 'ins': '+', 'del': '-'}
+    columns = []
+    for operation, element, event in alignment:
+        expected = tone_name(element) if element is not None else ''
+        played = ' '.join(sorted(event[1])) if event is not None else ''
+        if event is not None and len(event[1]) > 1:
+            played = '[%s]' % played
+        columns.append((expected, played, symbols[operation]))
+    widths = [max(len(cell) for cell in column) for column in columns]
+    rows = [
+        ' '.join(column[row].ljust(width) for column, width in zip(columns, widths)).rstrip()
+        for row in range(3)
+    ]
+    return 'Matched with distance %g:\n  expected: %s\n  played:   %s\n            %s' % (
+        distance, rows[0], rows[1], rows[2],
+    )
+
+def find_approximate_match(elements, events, args):
+    distance, alignment = approximate_match(elements, events, args)
+    if distance > args.max_distance:
+        return None
+    tones = [event for _, _, event in alignment if event is not None]
+    if not tones or not check_timing([onset for onset, _ in tones], args):
+        return None
+    print(describe_alignment(distance, alignment), file=sys.stderr)
+    return tones
+
+NOTE_NUMBERS = {'C': 0, 'D': 2, 'E': 4, 'F': 5, 'G': 7, 'A': 9, 'B': 11}
+NOTE_NAME = re.compile(r'([A-G])(#|b)?(-?\d+)$')
+
+def note_number(name):
+    """Return MIDI number of a note name like A4, F#3 or Bb2, or None."""
+    mo = NOTE_NAME.match(name)
+    if mo is None:
+        return None
+    number = NOTE_NUMBERS[mo.group(1)] + 12 * (int(mo.group(3)) + 1)
+    if mo.group(2) == '#':
+        number += 1
+    elif mo.group(2) == 'b':
+        number -= 1
+    return number
+
+def note_name(number):
+    names = ['C', 'C#', 'D', 'D#', 'E', 'F', 'F#', 'G', 'G#', 'A', 'A#', 'B']
+    return '%s%d' % (names[number % 12], number // 12 - 1)
+
+def sharp_name(name):
+    """Spell a note name with an octave like the analyzer does, so Bb3
+    matches A#3. Other names are returned unchanged."""
+    number = note_number(name)
+    if number is None:
+        return name
+    return note_name(number)
+
+def parse_contour(contour):
+    """Parse semitone steps between consecutive tones like "+2 +2 -4"."""
+    steps = []
+    for token in re.split(r'[\s,]+', contour.strip()):
+        try:
+            steps.append(int(token))
+        except ValueError:
+            raise ValueError('invalid semitone step %r' % token)
+    return steps
+
+def find_contour_match(contour, events, args):
+    """Match the semitone steps between the last tones in any key. Tones
+    which are not notes are ignored, the highest note of tones starting
+    together is taken as the melody."""
+    notes = []
+    for event in events:
+        if is_rest(event):
+            continue
+        numbers = [number for number in map(note_number, event[1]) if number is not None]
+        if numbers:
+            notes.append((event, max(numbers)))
+    notes = notes[-(len(contour) + 1):]
+    if len(notes) < len(contour) + 1:
+        return None
+    steps = [b - a for (_, a), (_, b) in zip(notes, notes[1:])]
+    if any(abs(step - expected) > args.interval_tolerance for step, expected in zip(steps, contour)):
+        return None
+    if not check_timing([event[0] for event, _ in notes], args):
+        return None
+    print('Matched contour starting by %s' % note_name(notes[0][1]), file=sys.stderr)
+    return [event for event, _ in notes]
+
+# events kept for matching, older ones are forgotten
+MAX_EVENTS = 64
+
+def find_match(sequence, events, args):
+    """Find a match of the sequence ending by the last event, which may be
+    followed by a rest, whose tones satisfy the timing. Return the matched
+    events or None."""
+    ends = [len(events)]
+    if events and is_rest(events[-1]):
+        ends.append(len(events) - 1)
+    memo = {}
+    for start in range(len(events)):
+        for end in match(sequence, events, start, memo):
+            # every tone between start and end is matched by the sequence
+            tones = [event for event in events[start:end] if not is_rest(event)]
+            if end in ends and tones and check_timing([onset for onset, _ in tones], args):
+                return tones
+    return None
+
+LOCK_SCHEME = 'pbkdf2-sha256'
+LOCK_ITERATIONS = 200000
+
+def lock_melody(node):
+    """Return the melody of a sequence stored by a lock, i.e. the names of
+    tones joined by + when they start together."""
+    elements = tone_elements(node)
+    if any(element.names is None for element in elements):
+        raise SequenceError('a lock supports only tones and "[...]"', 0)
+    return ['+'.join(sorted(element.names)) for element in elements]
+
+def lock_digest(melody, salt, iterations):
+    return hashlib.pbkdf2_hmac('sha256', ' '.join(melody).encode(), salt, iterations)
+
+def make_lock(melody):
+    """Return the hash of the melody used by --lock. The number of tones is
+    kept in plain text, it is needed to tell when an attempt is complete."""
+    salt = secrets.token_bytes(16)
+    digest = lock_digest(melody, salt, LOCK_ITERATIONS)
+    return '%s:%d:%d:%s:%s' % (LOCK_SCHEME, LOCK_ITERATIONS, len(melody), salt.hex(), digest.hex())
+
+class MelodyLock:
+    """Opens when the melody whose hash it holds is played within the time
+    window. Every complete attempt which does not match is a failure, too
+    many of them lock the lock for a while. Attempts are written to the
+    log."""
+    def __init__(self, lock, args):
+        try:
+            scheme, iterations, length, salt, digest = lock.split(':')
+            if scheme != LOCK_SCHEME:
+                raise ValueError('unsupported scheme %r' % scheme)
+            self.iterations = int(iterations)
+            self.length = int(length)
+            self.salt = bytes.fromhex(salt)
+            self.digest = bytes.fromhex(digest)
+        except ValueError as error:
+            raise ValueError('invalid lock hash: %s' % error)
+        if self.length < 1:
+            raise ValueError('invalid lock hash: no tones')
+        self.args = args
+        self.attempt = []
+        self.failures = 0
+        # monotonic time until which tones are ignored and why
+        self.blocked_until = None
+        self.blocked = None
+
+    def expire(self, now):
+        """Forget an attempt not finished in the window and end a lockout
+        or the time until re-arming."""
+        if self.attempt and now - self.attempt[0][0] > self.args.lock_window:
+            log('Lock: attempt timed out after %d of %d tones' % (len(self.attempt), self.length))
+            self.attempt = []
+        if self.blocked_until is not None and now >= self.blocked_until:
+            log('Lock: %s ended, lock armed' % self.blocked)
+            self.blocked_until = None
+            self.blocked = None
+
+    def feed(self, event):
+        """Add a detected event, return the attempt when it opens the lock."""
+        if is_rest(event):
+            return None
+        if self.blocked_until is not None:
+            if self.blocked == 'lockout' and not self.ignored:
+                log('Lock: ignoring tones during lockout')
+                self.ignored = True
+            return None
+        self.attempt.append(event)
+        if len(self.attempt) < self.length:
+            return None
+        attempt, self.attempt = self.attempt, []
+        melody = ['+'.join(sorted(tones)) for _, tones in attempt]
+        duration = attempt[-1][0] - attempt[0][0]
+        matched = hmac.compare_digest(lock_digest(melody, self.salt, self.iterations), self.digest)
+        if matched and check_timing([onset for onset, _ in attempt], self.args):
+            log('Lock: opened after %.1f s' % duration)
+            self.failures = 0
+            if self.args.rearm is not None:
+                self.block('re-arming', attempt[-1][0] + self.args.rearm)
+            return attempt
+        self.failures += 1
+        log('Lock: attempt %d of %d failed after %.1f s' % (self.failures, self.args.max_attempts, duration))
+        if self.failures >= self.args.max_attempts:
+            log('Lock: locked out for %g s' % self.args.lockout)
+            self.failures = 0
+            self.block('lockout', attempt[-1][0] + self.args.lockout)
+        return None
+
+    def block(self, reason, until):
+        self.blocked = reason
+        self.blocked_until = until
+        self.ignored = False
+
+log_lock = threading.Lock()
+log_file = sys.stderr
+
+def log(message):
+    with log_lock:
+        print('%s %s' % (time.strftime('%Y-%m-%d %H:%M:%S'), message), file=log_file, flush=True)
+
+def describe_match(sequence, tones, count):
+    """Return the match details passed to the actions."""
+    # onsets are monotonic times
+    offset = time.time() - time.monotonic()
+    return {
+        'sequence': sequence,
+        # tones starting together are joined by +
+        'notes': ['+'.join(sorted(event[1])) for event in tones],
+        'times': [round(onset + offset, 3) for onset, _ in tones],
+        'count': count,
+    }
+
+class ActionRunner:
+    """Run the actions of every match in a separate thread. At most
+    max_running matches are handled at once, matches are skipped while the
+    limit is reached."""
+    def __init__(self, actions, args):
+        self.actions = actions
+        self.slots = None
+        if args.max_running > 0:
+            self.slots = threading.BoundedSemaphore(args.max_running)
+        self.threads = []
+
+    def run(self, sequence, tones, count):
+        if self.slots is not None and not self.slots.acquire(blocking=False):
+            log('Skipped action #%d, too many actions are running' % count)
+            return
+        thread = threading.Thread(target=self.execute, args=(describe_match(sequence, tones, count),))
+        thread.start()
+        self.threads = [thread for thread in self.threads if thread.is_alive()]
+        self.threads.append(thread)
+
+    def execute(self, match):
+        try:
+            for action in self.actions:
+                action.perform(match)
+        finally:
+            if self.slots is not None:
+                self.slots.release()
+
+    def wait(self):
+        for thread in self.threads:
+            thread.join()
+
+class CommandAction:
+    """Run the command in its own process group, so the whole group can be
+    killed on timeout, and log its output and exit code."""
+    def __init__(self, command, args):
+        self.command = command
+        self.timeout = args.timeout
+        self.kill_grace = args.kill_grace
+
+    def perform(self, match):
+        count = match['count']
+        env = dict(
+            os.environ,
+            TRIGGER_SEQUENCE=match['sequence'],
+            TRIGGER_NOTES=' '.join(match['notes']),
+            TRIGGER_TIMES=' '.join('%.3f' % onset for onset in match['times']),
+            TRIGGER_COUNT=str(count),
+        )
+        try:
+            process = subprocess.Popen(
+                self.command, env=env, stdout=subprocess.PIPE, stderr=subprocess.STDOUT,
+                start_new_session=True,
+            )
+        except OSError as error:
+            log('Action #%d failed to start: %s' % (count, error))
+            return
+        log('Action #%d started as %d' % (count, process.pid))
+        try:
+            output, _ = process.communicate(timeout=self.timeout)
+        except subprocess.TimeoutExpired:
+            log('Action #%d timed out after %g s, killing it' % (count, self.timeout))
+            self.kill(process)
+            try:
+                output, _ = process.communicate(timeout=self.kill_grace)
+            except subprocess.TimeoutExpired:
+                # a process which left the group keeps the output open
+                log('Action #%d left processes holding its output' % count)
+                process.stdout.close()
+                process.wait()
+                output = b''
+        for line in output.decode(errors='replace').splitlines():
+            log('Action #%d: %s' % (count, line))
+        log('Action #%d exited with code %d' % (count, process.returncode))
+
+    def kill(self, process):
+        """Terminate the process group and kill what is left of it after
+        the grace period, other processes of the group may outlive the
+        command itself."""
+        group = process.pid
+        try:
+            os.killpg(group, signal.SIGTERM)
+        except ProcessLookupError:
+            return
+        deadline = time.monotonic() + self.kill_grace
+        while time.monotonic() < deadline:
+            # reap the command so the group ends with its last process
+            process.poll()
+            try:
+                os.killpg(group, 0)
+            except ProcessLookupError:
+                return
+            time.sleep(0.05)
+        try:
+            os.killpg(group, signal.SIGKILL)
+        except ProcessLookupError:
+            pass
+
+class HttpAction:
+    """Send the match details in a JSON body, retrying with exponential
+    backoff on connection errors, timeouts and server errors."""
+    def __init__(self, args):
+        self.url = args.http_url
+        self.method = args.http_method.upper()
+        self.headers = {'Content-Type': 'application/json'}
+        for header in args.http_header:
+            name, separator, value = header.partition(':')
+            if not separator or not name.strip():
+                raise ValueError('invalid header %r, expected "Name: value"' % header)
+            self.headers[name.strip()] = value.strip()
+        self.template = None
+        if args.http_body is not None:
+            self.template = string.Template(args.http_body)
+            # check the template by an example match, the values have to
+            # be filled in to find them quoted
+            example = [(time.monotonic(), frozenset(['C4'])), (time.monotonic(), frozenset(['E4', 'G4']))]
+            try:
+                json.loads(self.body(describe_match('C4 [E4 G4]', example, 1)))
+            except (KeyError, ValueError) as error:
+                raise ValueError('invalid body template: %s' % error)
+        self.timeout = args.http_timeout
+        self.retries = args.http_retries
+        self.backoff = args.http_backoff
+
+    def body(self, match):
+        if self.template is None:
+            return json.dumps(match)
+        # values are inserted as JSON, so strings are quoted
+        return self.template.substitute({name: json.dumps(value) for name, value in match.items()})
+
+    def perform(self, match):
+        count = match['count']
+        request = urllib.request.Request(
+            self.url, data=self.body(match).encode(), headers=self.headers, method=self.method,
+        )
+        for attempt in range(self.retries + 1):
+            if attempt > 0:
+                time.sleep(self.backoff * 2 ** (attempt - 1))
+            try:
+                with urllib.request.urlopen(request, timeout=self.timeout) as response:
+                    log('Action #%d: %s %s returned %d' % (count, self.method, self.url, response.status))
+                    return
+            except urllib.error.HTTPError as error:
+                log('Action #%d: %s %s returned %d' % (count, self.method, self.url, error.code))
+                # retrying does not help requests rejected by the server
+                if error.code < 500 and error.code != 429:
+                    return
+            except (urllib.error.URLError, OSError) as error:
+                log('Action #%d: %s %s failed: %s' % (count, self.method, self.url, getattr(error, 'reason', error)))
+        log('Action #%d: giving up after %d attempts' % (count, self.retries + 1))
+
 def main(*in_args):
     parser = argparse.ArgumentParser('Trigger event when specific sequence is read.')
     parser.add_argument(
-        'sequence',
-        help='Sequence to be accepted',
+        'sequence', nargs='?',
+        help='Sequence to be accepted. Tones are separated by spaces, only words made of note names like GBAD '
+        'are split to notes. Older versions took every character as a tone, write "a b c" instead of "abc".',
     )
     parser.add_argument(
-        'command_arg', nargs='+',
+        'command_arg', nargs='*',
         help='Arguments of command to be executed when sequence is hit.',
     )
     parser.add_argument(
@@ -44,38 +762,249 @@ def main(*in_args):
         '-c', '--count', type=int, default=-1,
         help='How many times should the command be triggered. When set to -1, repead indefinetly.',
     )
-    args = parser.parse_args(in_args)
-    pattern = make_pattern(args.sequence)
-    regexp = re.compile(pattern)
+    parser.add_argument(
+        '--rhythm',
+        help='Durations of the tones in quarter notes, e.g. "q q h" or "1 1 2". '
+        'Note values w, h, q, e and s may be dotted.',
+    )
+    parser.add_argument(
+        '--rhythm-tolerance', type=float, default=0.25,
+        help='Allowed relative deviation of every tone from the rhythm.',
+    )
+    parser.add_argument(
+        '--tempo', type=float,
+        help='Expected tempo in quarter notes per minute, any tempo is accepted when not set.',
+    )
+    parser.add_argument(
+        '--tempo-tolerance', type=float, default=0.2,
+        help='Allowed relative deviation from --tempo.',
+    )
+    parser.add_argument(
+        '--timeout', type=float,
+        help='Kill the command with all its children after this many seconds.',
+    )
+    parser.add_argument(
+        '--kill-grace', type=float, default=5,
+        help='Seconds between SIGTERM and SIGKILL of a timed out command.',
+    )
+    parser.add_argument(
+        '--max-running', type=int, default=0,
+        help='Maximal number of commands running at once, further matches are skipped. '
+        'When set to 0, unlimited.',
+    )
+    parser.add_argument(
+        '--http-url',
+        help='Send a request to this URL when sequence is hit.',
+    )
+    parser.add_argument(
+        '--http-method', default='POST',
+        help='Method of the request.',
+    )
+    parser.add_argument(
+        '--http-header', action='append', default=[],
+        help='Header of the request as "Name: value", may be repeated.',
+    )
+    parser.add_argument(
+        '--http-body',
+        help='JSON body template, $sequence, $notes, $times and $count are replaced by JSON values. '
+        'By default all of them are sent in an object.',
+    )
+    parser.add_argument(
+        '--http-timeout', type=float, default=10,
+        help='Timeout of every attempt in seconds.',
+    )
+    parser.add_argument(
+        '--http-retries', type=int, default=3,
+        help='Number of retries after a failed attempt.',
+    )
+    parser.add_argument(
+        '--http-backoff', type=float, default=1,
+        help='Delay before the first retry in seconds, it doubles with every retry.',
+    )
+    parser.add_argument(
+        '--log',
+        help='Append start, output and exit code of the commands to this file instead of stderr.',
+    )
+    parser.add_argument(
+        '--contour', action='store_true',
+        help='The sequence is semitone steps between notes like "+2 +2 -4", which match in any key.',
+    )
+    parser.add_argument(
+        '--interval-tolerance', type=int, default=0,
+        help='Allowed deviation of every --contour step in semitones.',
+    )
+    parser.add_argument(
+        '--max-distance', type=float,
+        help='Trigger when the played tones are within this edit distance from the sequence.',
+    )
+    parser.add_argument(
+        '--substitution-cost', type=float, default=1,
+        help='Cost of a tone played instead of the expected one.',
+    )
+    parser.add_argument(
+        '--insertion-cost', type=float, default=1,
+        help='Cost of an extra played tone.',
+    )
+    parser.add_argument(
+        '--deletion-cost', type=float, default=1,
+        help='Cost of a missed tone.',
+    )
+    parser.add_argument(
+        '--max-gap', type=float,
+        help='Maximal time in seconds between two tones of the sequence.',
+    )
+    parser.add_argument(
+        '--max-time', type=float,
+        help='Maximal time in seconds from the first to the last tone of the sequence.',
+    )
+    parser.add_argument(
+        '--lock', action='store_true',
+        help='The sequence is a hash made by --make-lock, which opens a melody lock.',
+    )
+    parser.add_argument(
+        '--make-lock', action='store_true',
+        help='Print the hash of a sequence read from the terminal or stdin for --lock.',
+    )
+    parser.add_argument(
+        '--lock-window', type=float, default=10,
+        help='Time in seconds to play the whole sequence of a lock.',
+    )
+    parser.add_argument(
+        '--max-attempts', type=int, default=3,
+        help='Number of failed attempts to open a lock before it is locked out.',
+    )
+    parser.add_argument(
+        '--lockout', type=float, default=60,
+        help='Time in seconds tones are ignored after too many failed attempts.',
+    )
+    parser.add_argument(
+        '--rearm', type=float,
+        help='Time in seconds after which an opened lock may be opened again. By default it opens once.',
+    )
+    args = parser.parse_intermixed_args(in_args)
+    if args.make_lock:
+        if sys.stdin.isatty():
+            line = getpass.getpass('Sequence: ')
+            if getpass.getpass('Repeat sequence: ') != line:
+                parser.error('the sequences differ')
+        else:
+            line = sys.stdin.readline().strip()
+        try:
+            print(make_lock(lock_melody(parse_sequence(line))))
+        except SequenceError as error:
+            parser.error('invalid sequence: %s' % error.describe(line))
+        return
+    if args.sequence is None:
+        parser.error('the sequence is required')
+    lock = None
+    if args.lock and args.contour:
+        parser.error('--lock can not be combined with --contour')
+    contour = None
+    if args.contour:
+        try:
+            contour = parse_contour(args.sequence)
+        except ValueError as error:
+            parser.error('invalid contour: %s' % error)
+        if args.max_distance is not None:
+            parser.error('--max-distance can not be combined with --contour')
+        sequence = Concat([Tone(None)] * (len(contour) + 1))
+    elif args.lock:
+        try:
+            lock = MelodyLock(args.sequence, args)
+        except ValueError as error:
+            parser.error(str(error))
+        if args.max_distance is not None:
+            parser.error('--max-distance can not be combined with --lock')
+        if args.max_attempts < 1:
+            parser.error('--max-attempts has to be at least 1')
+        sequence = Concat([Tone(None)] * lock.length)
+    else:
+        try:
+            sequence = parse_sequence(args.sequence)
+        except SequenceError as error:
+            parser.error('invalid sequence: %s' % error.describe(args.sequence))
+    if args.rhythm is not None:
+        try:
+            args.rhythm = parse_rhythm(args.rhythm)
+        except ValueError as error:
+            parser.error('--rhythm: %s' % error)
+        low, high = tone_count(sequence)
+        if len(args.rhythm) + 1 < low or (high is not None and len(args.rhythm) > high):
+            parser.error('--rhythm needs a duration for every tone of the sequence')
+    if args.tempo is not None and args.rhythm is None:
+        parser.error('--tempo needs --rhythm')
+    elements = None
+    if args.max_distance is not None:
+        try:
+            elements = tone_elements(sequence)
+        except SequenceError as error:
+            parser.error('invalid sequence: %s' % error.describe(args.sequence))
+        if args.rhythm is not None:
+            parser.error('--rhythm can not be combined with --max-distance')
     valid_line = re.compile(r"\[([^\]]*)\]$")
     count = 0
     max_count = args.count
     if max_count < 0:
         max_count = float('inf')
-    command = functools.partial(subprocess.Popen, args.command_arg)
-    data = io.StringIO()
+    if lock is not None and args.rearm is None:
+        max_count = min(max_count, 1)
+    if args.log is not None:
+        global log_file
+        log_file = open(args.log, 'a')
+    actions = []
+    if args.command_arg:
+        actions.append(CommandAction(args.command_arg, args))
+    if args.http_url is not None:
+        try:
+            actions.append(HttpAction(args))
+        except ValueError as error:
+            parser.error('--http-body or --http-header: %s' % error)
+    if not actions:
+        parser.error('a command or --http-url is needed')
+    runner = ActionRunner(actions, args)
+    # (time, tones) of detected onsets, tones are None for a rest
+    events = []
     previous = set()
     current = set()
     while True:
         if count >= max_count:
             if args.keep_reading:
+                # drain the input until EOF without matching
+                if sys.stdin.readline() == '':
+                    break
                 continue
             else:
                 break
         line = sys.stdin.readline()
         if line == '':
             break
+        now = time.monotonic()
+        if lock is not None:
+            lock.expire(now)
         previous, current = parse_line(valid_line, line.rstrip('\n'), previous)
         if len(previous) < 1 and len(current) < 1: # Two empty brackets in a row
-            data.write(" ")
+            events.append((now, None))
+        elif current:
+            events.append((now, frozenset(current)))
+        else:
+            continue
+        del events[:-MAX_EVENTS]
+        if lock is not None:
+            matched = lock.feed(events[-1])
+            if matched:
+                # the melody is not passed to the actions
+                matched = [(onset, frozenset('?')) for onset, _ in matched]
+        elif contour is not None:
+            matched = find_contour_match(contour, events, args)
+        elif elements is not None:
+            matched = find_approximate_match(elements, events, args)
         else:
-            for c in sorted(list(current)):
-                data.write(c)
-        #print('Data:', data.getvalue())
-        if regexp.search(data.getvalue()):
-            data = io.StringIO()
+            matched = find_match(sequence, events, args)
+        if matched:
+            events = []
             count += 1
-            command()
+            runner.run(args.sequence, matched, count)
+    runner.wait()
 
 if __name__ == "__main__":
     sys.exit(main(*sys.argv[1:]))
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unsafe"
+	"github.com/veandco/go-sdl2/sdl"
+)
+
+// View selects the panels shown in the debug window.
+type View int
+
+const (
+	viewSpectrum View = iota
+	viewBoth
+	viewWaterfall
+)
+
+var viewNames = []string{"spectrum", "both", "waterfall"}
+
+func (view View) String() string {
+	return viewNames[view]
+}
+
+func (view *View) Set(value string) error {
+	for i, name := range viewNames {
+		if name == value {
+			*view = (View)(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown view %q, expected one of: %s", value, strings.Join(viewNames, ", "))
+}
+
+func (view View) next() View {
+	return (view + 1) % (View)(len(viewNames))
+}
+
+type waterfallRow struct {
+	ticks uint32
+	values []float64
+	detected string
+	// detected tones changed to a non-empty set
+	onset bool
+}
+
+// Waterfall keeps spectra of the last duration milliseconds.
+type Waterfall struct {
+	rows []waterfallRow
+	// index of the newest row
+	newest int
+	count int
+	duration uint32
+}
+
+func (waterfall *Waterfall) init(options Options) {
+	waterfall.duration = (uint32)(options.waterfallSeconds * 1000)
+	size := (int)(waterfall.duration)/(int)(math.Max(1, (float64)(options.interval))) + 1
+	waterfall.rows = make([]waterfallRow, size)
+	for i := range waterfall.rows {
+		waterfall.rows[i].values = make([]float64, options.samples/2)
+	}
+	waterfall.newest = -1
+}
+
+func (waterfall *Waterfall) row(age int) *waterfallRow {
+	return &waterfall.rows[(waterfall.newest-age+len(waterfall.rows))%len(waterfall.rows)]
+}
+
+func (waterfall *Waterfall) push(data *AggregatedData, detected []string) {
+	previous := ""
+	if waterfall.count > 0 {
+		previous = waterfall.row(0).detected
+	}
+	waterfall.newest = (waterfall.newest + 1) % len(waterfall.rows)
+	if waterfall.count < len(waterfall.rows) {
+		waterfall.count++
+	}
+	row := waterfall.row(0)
+	row.ticks = ticks()
+	copy(row.values, data.values)
+	row.detected = strings.Join(detected, " ")
+	row.onset = row.detected != previous && row.detected != ""
+}
+
+// colorMap goes from black through purple, red and yellow to white.
+var colorMap = []sdl.Color{
+	{0, 0, 0, 255},
+	{80, 0, 120, 255},
+	{200, 30, 40, 255},
+	{250, 200, 0, 255},
+	{255, 255, 255, 255},
+}
+
+func mapColor(level float64) sdl.Color {
+	level = math.Max(0, math.Min(1, level)) * (float64)(len(colorMap)-1)
+	index := (int)(math.Floor(level))
+	if index >= len(colorMap)-1 {
+		return colorMap[len(colorMap)-1]
+	}
+	ratio := level - (float64)(index)
+	mix := func(a, b uint8) uint8 {
+		return (uint8)((float64)(a)*(1-ratio) + (float64)(b)*ratio)
+	}
+	from, to := colorMap[index], colorMap[index+1]
+	return sdl.Color{mix(from.R, to.R), mix(from.G, to.G), mix(from.B, to.B), 255}
+}
+
+const colorLevels = 256
+
+func (gui *Gui) drawWaterfall() {
+	area := gui.waterfallArea
+	waterfall := &gui.waterfall
+	if area.H <= 0 || area.W <= 0 || waterfall.count == 0 {
+		return
+	}
+	format := gui.surface.Format
+	if format == nil || format.BytesPerPixel != 4 {
+		return
+	}
+	palette := make([]uint32, colorLevels)
+	for i := range palette {
+		color := mapColor((float64)(i) / (colorLevels - 1))
+		palette[i] = sdl.MapRGBA(format, color.R, color.G, color.B, color.A)
+	}
+	// bins shown by every column
+	columnFrom := make([]int, area.W)
+	columnTo := make([]int, area.W)
+	for x := range columnFrom {
+		columnFrom[x], columnTo[x] = gui.columnBins((int32)(x), area.W, len(waterfall.rows[0].values))
+	}
+	newest := waterfall.row(0).ticks
+	gui.surface.Lock()
+	pixels := gui.surface.Pixels()
+	pitch := (int)(gui.surface.Pitch)
+	age := 0
+	for y := (int32)(0); y < area.H; y++ {
+		// time shown on this line, newest on top
+		time := (uint32)((float64)(y) / (float64)(area.H) * (float64)(waterfall.duration))
+		for age+1 < waterfall.count && newest-waterfall.row(age+1).ticks <= time {
+			age++
+		}
+		row := waterfall.row(age)
+		if age == waterfall.count-1 && newest-row.ticks < time {
+			// older than the oldest row
+			break
+		}
+		line := (int)(area.Y+y) * pitch
+		for x := range columnFrom {
+			value := 0.0
+			for bin := columnFrom[x]; bin < columnTo[x]; bin++ {
+				value = math.Max(value, row.values[bin])
+			}
+			level := (int)(gui.settings.level(value) * (colorLevels - 1))
+			level = (int)(math.Max(0, math.Min(colorLevels-1, (float64)(level))))
+			offset := line + ((int)(area.X)+x)*4
+			*(*uint32)(unsafe.Pointer(&pixels[offset])) = palette[level]
+		}
+	}
+	gui.surface.Unlock()
+	// time axis
+	for second := (uint32)(1); second*1000 < waterfall.duration; second++ {
+		y := area.Y + (int32)((float64)(second*1000)/(float64)(waterfall.duration)*(float64)(area.H))
+		tickRect := sdl.Rect{area.X, y, 10, 1}
+		gui.surface.FillRect(&tickRect, scaleColor.Uint32())
+		gui.printAt(sdl.Rect{area.X + 12, y, 0, 0}, "-%d s", second)
+	}
+	// mark onsets and detected tones
+	markColor := sdl.Color{255, 255, 255, 255}.Uint32()
+	for age := 0; age < waterfall.count; age++ {
+		row := waterfall.row(age)
+		elapsed := newest - row.ticks
+		if elapsed > waterfall.duration {
+			break
+		}
+		if !row.onset {
+			continue
+		}
+		markRect := sdl.Rect{area.X, area.Y + (int32)((float64)(elapsed)/(float64)(waterfall.duration)*(float64)(area.H)), area.W, 1}
+		gui.surface.FillRect(&markRect, markColor)
+		gui.printAt(sdl.Rect{area.X + area.W - 2*minScaleSpacing, markRect.Y, 0, 0}, "%s", row.detected)
+	}
+}
+
+// columnBins returns range of bins shown in column x of a panel.
+func (gui *Gui) columnBins(x int32, width int32, maxBin int) (int, int) {
+	from := (int)(math.Round(gui.settings.binAt((float64)(x) / (float64)(width))))
+	to := (int)(math.Round(gui.settings.binAt((float64)(x+1) / (float64)(width))))
+	from = (int)(math.Max(0, math.Min((float64)(from), (float64)(maxBin-1))))
+	to = (int)(math.Max((float64)(from+1), math.Min((float64)(to), (float64)(maxBin))))
+	return from, to
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	wavFormatPCM = 1
+	wavFormatFloat = 3
+	wavFormatExtensible = 0xfffe
+)
+
+// WavFile holds samples of a WAV file mixed down to mono.
+type WavFile struct {
+	rate int
+	samples []float32
+}
+
+type wavFormat struct {
+	AudioFormat uint16
+	Channels uint16
+	SampleRate uint32
+	ByteRate uint32
+	BlockAlign uint16
+	BitsPerSample uint16
+}
+
+func readWav(filename string) (*WavFile, error) {
+	file, error := os.Open(filename)
+	if error != nil {
+		return nil, error
+	}
+	defer file.Close()
+	var header [12]byte
+	if _, error = io.ReadFull(file, header[:]); error != nil {
+		return nil, error
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("%s is not a WAV file", filename)
+	}
+	var format *wavFormat
+	for {
+		var chunk [8]byte
+		if _, error = io.ReadFull(file, chunk[:]); error != nil {
+			if error == io.EOF {
+				return nil, fmt.Errorf("%s has no data", filename)
+			}
+			return nil, error
+		}
+		size := (int64)(binary.LittleEndian.Uint32(chunk[4:8]))
+		// chunks are aligned to two bytes
+		padded := size + size%2
+		switch string(chunk[0:4]) {
+		case "fmt ":
+			body := make([]byte, padded)
+			if _, error = io.ReadFull(file, body); error != nil {
+				return nil, error
+			}
+			if size < 16 {
+				return nil, errors.New("Invalid WAV format chunk.")
+			}
+			format = &wavFormat{
+				binary.LittleEndian.Uint16(body[0:2]),
+				binary.LittleEndian.Uint16(body[2:4]),
+				binary.LittleEndian.Uint32(body[4:8]),
+				binary.LittleEndian.Uint32(body[8:12]),
+				binary.LittleEndian.Uint16(body[12:14]),
+				binary.LittleEndian.Uint16(body[14:16]),
+			}
+			if format.AudioFormat == wavFormatExtensible && size >= 26 {
+				// the sub format GUID starts by the format code
+				format.AudioFormat = binary.LittleEndian.Uint16(body[24:26])
+			}
+		case "data":
+			if format == nil {
+				return nil, errors.New("WAV data precede the format chunk.")
+			}
+			body := make([]byte, size)
+			// a truncated file is decoded up to its end
+			n, error := io.ReadFull(file, body)
+			if error != nil && error != io.ErrUnexpectedEOF {
+				return nil, error
+			}
+			samples, error := format.decode(body[:n])
+			if error != nil {
+				return nil, error
+			}
+			return &WavFile{(int)(format.SampleRate), samples}, nil
+		default:
+			if _, error = file.Seek(padded, io.SeekCurrent); error != nil {
+				return nil, error
+			}
+		}
+	}
+}
+
+// decode converts frames to mono samples in range from -1 to 1.
+func (format *wavFormat) decode(body []byte) ([]float32, error) {
+	width := (int)(format.BitsPerSample) / 8
+	channels := (int)(format.Channels)
+	var sample func(data []byte) float64
+	switch {
+	case format.AudioFormat == wavFormatPCM && width == 1:
+		sample = func(data []byte) float64 {
+			return ((float64)(data[0]) - 128) / 128
+		}
+	case format.AudioFormat == wavFormatPCM && width == 2:
+		sample = func(data []byte) float64 {
+			return (float64)((int16)(binary.LittleEndian.Uint16(data))) / (1 << 15)
+		}
+	case format.AudioFormat == wavFormatPCM && width == 3:
+		sample = func(data []byte) float64 {
+			value := (int32)(data[0])<<8 | (int32)(data[1])<<16 | (int32)(data[2])<<24
+			return (float64)(value) / (1 << 31)
+		}
+	case format.AudioFormat == wavFormatPCM && width == 4:
+		sample = func(data []byte) float64 {
+			return (float64)((int32)(binary.LittleEndian.Uint32(data))) / (1 << 31)
+		}
+	case format.AudioFormat == wavFormatFloat && width == 4:
+		sample = func(data []byte) float64 {
+			return (float64)(math.Float32frombits(binary.LittleEndian.Uint32(data)))
+		}
+	case format.AudioFormat == wavFormatFloat && width == 8:
+		sample = func(data []byte) float64 {
+			return math.Float64frombits(binary.LittleEndian.Uint64(data))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported WAV format %d with %d bits per sample", format.AudioFormat, format.BitsPerSample)
+	}
+	if channels == 0 {
+		return nil, errors.New("WAV file has no channels.")
+	}
+	frameSize := width * channels
+	samples := make([]float32, len(body)/frameSize)
+	for i := range samples {
+		frame := body[i*frameSize:]
+		sum := 0.0
+		for channel := 0; channel < channels; channel++ {
+			sum += sample(frame[channel*width:])
+		}
+		samples[i] = (float32)(sum / (float64)(channels))
+	}
+	return samples, nil
+}
+
+// WavWriter writes mono 32 bit float samples.
+type WavWriter struct {
+	file *os.File
+	writer *bufio.Writer
+	samples int
+}
+
+const wavHeaderSize = 44
+
+func createWav(filename string, rate int) (*WavWriter, error) {
+	file, error := os.Create(filename)
+	if error != nil {
+		return nil, error
+	}
+	wav := &WavWriter{file, bufio.NewWriter(file), 0}
+	header := make([]byte, wavHeaderSize)
+	copy(header[0:4], "RIFF")
+	copy(header[8:16], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16)
+	binary.LittleEndian.PutUint16(header[20:22], wavFormatFloat)
+	binary.LittleEndian.PutUint16(header[22:24], 1)
+	binary.LittleEndian.PutUint32(header[24:28], (uint32)(rate))
+	binary.LittleEndian.PutUint32(header[28:32], (uint32)(rate*4))
+	binary.LittleEndian.PutUint16(header[32:34], 4)
+	binary.LittleEndian.PutUint16(header[34:36], 32)
+	copy(header[36:40], "data")
+	// sizes are filled in by close
+	if _, error = wav.writer.Write(header); error != nil {
+		file.Close()
+		return nil, error
+	}
+	return wav, nil
+}
+
+func (wav *WavWriter) write(samples []float32) error {
+	var buffer [4]byte
+	for _, sample := range samples {
+		binary.LittleEndian.PutUint32(buffer[:], math.Float32bits(sample))
+		if _, error := wav.writer.Write(buffer[:]); error != nil {
+			return error
+		}
+	}
+	wav.samples += len(samples)
+	return nil
+}
+
+// seconds returns length of the written samples.
+func (wav *WavWriter) seconds(rate int) float64 {
+	return (float64)(wav.samples) / (float64)(rate)
+}
+
+func (wav *WavWriter) close() error {
+	error := wav.writer.Flush()
+	size := (uint32)(wav.samples * 4)
+	var buffer [4]byte
+	if error == nil {
+		binary.LittleEndian.PutUint32(buffer[:], wavHeaderSize-8+size)
+		_, error = wav.file.WriteAt(buffer[:], 4)
+	}
+	if error == nil {
+		binary.LittleEndian.PutUint32(buffer[:], size)
+		_, error = wav.file.WriteAt(buffer[:], wavHeaderSize-4)
+	}
+	if error != nil {
+		wav.file.Close()
+		return error
+	}
+	return wav.file.Close()
+}
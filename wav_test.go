@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWavRoundTrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "round.wav")
+	wav, error := createWav(filename, 44100)
+	if error != nil {
+		t.Fatal(error)
+	}
+	samples := []float32{0, 0.5, -0.5, 1, -1, 0.123456}
+	// written in two parts like frames of the recorder
+	if error = wav.write(samples[:2]); error != nil {
+		t.Fatal(error)
+	}
+	if error = wav.write(samples[2:]); error != nil {
+		t.Fatal(error)
+	}
+	if seconds := wav.seconds(44100); seconds != 6.0/44100 {
+		t.Errorf("seconds: got %g", seconds)
+	}
+	if error = wav.close(); error != nil {
+		t.Fatal(error)
+	}
+	read, error := readWav(filename)
+	if error != nil {
+		t.Fatal(error)
+	}
+	if read.rate != 44100 {
+		t.Errorf("rate: got %d, expected 44100", read.rate)
+	}
+	if len(read.samples) != len(samples) {
+		t.Fatalf("got %d samples, expected %d", len(read.samples), len(samples))
+	}
+	for i, sample := range samples {
+		if read.samples[i] != sample {
+			t.Errorf("sample %d: got %g, expected %g", i, read.samples[i], sample)
+		}
+	}
+}
+
+// writePCM writes a 16 bit PCM file with an extra chunk before the data.
+func writePCM(t *testing.T, filename string, channels int, frames []int16) {
+	data := make([]byte, 2*len(frames))
+	for i, value := range frames {
+		binary.LittleEndian.PutUint16(data[2*i:], (uint16)(value))
+	}
+	header := make([]byte, 0, 64)
+	header = append(header, "RIFF\x00\x00\x00\x00WAVE"...)
+	format := make([]byte, 24)
+	copy(format, "fmt ")
+	binary.LittleEndian.PutUint32(format[4:], 16)
+	binary.LittleEndian.PutUint16(format[8:], wavFormatPCM)
+	binary.LittleEndian.PutUint16(format[10:], (uint16)(channels))
+	binary.LittleEndian.PutUint32(format[12:], 8000)
+	binary.LittleEndian.PutUint32(format[16:], (uint32)(8000*2*channels))
+	binary.LittleEndian.PutUint16(format[20:], (uint16)(2*channels))
+	binary.LittleEndian.PutUint16(format[22:], 16)
+	header = append(header, format...)
+	header = append(header, "LIST\x03\x00\x00\x00abc\x00"...)
+	header = append(header, "data\x00\x00\x00\x00"...)
+	binary.LittleEndian.PutUint32(header[len(header)-4:], (uint32)(len(data)))
+	if error := os.WriteFile(filename, append(header, data...), 0644); error != nil {
+		t.Fatal(error)
+	}
+}
+
+func TestWavPCMStereo(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "stereo.wav")
+	writePCM(t, filename, 2, []int16{16384, 0, -32768, -32768, 100, -100})
+	read, error := readWav(filename)
+	if error != nil {
+		t.Fatal(error)
+	}
+	expected := []float32{0.25, -1, 0}
+	if len(read.samples) != len(expected) {
+		t.Fatalf("got %d samples, expected %d", len(read.samples), len(expected))
+	}
+	for i := range expected {
+		if read.samples[i] != expected[i] {
+			t.Errorf("sample %d: got %g, expected %g", i, read.samples[i], expected[i])
+		}
+	}
+}
+
+func TestWavTruncated(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "truncated.wav")
+	writePCM(t, filename, 1, []int16{1000, 2000, 3000, 4000})
+	content, _ := os.ReadFile(filename)
+	// cut the file in the middle of the third sample
+	os.WriteFile(filename, content[:len(content)-3], 0644)
+	read, error := readWav(filename)
+	if error != nil {
+		t.Fatal(error)
+	}
+	if len(read.samples) != 2 {
+		t.Errorf("got %d samples of a truncated file, expected 2", len(read.samples))
+	}
+}